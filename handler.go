@@ -1,14 +1,36 @@
 package slogtraq
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"maps"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
 	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/traPtitech/go-traq"
 )
@@ -20,16 +42,396 @@ type Option struct {
 	BotToken  string
 	// OnInternalError is an optional callback called when an internal error occurs.
 	OnInternalError func(err error)
+	// OnError is called with the content that could not be delivered when a send fails
+	// for good, after any retries, e.g. to write it elsewhere or to alert.
+	OnError func(ctx context.Context, err error, content string)
+	// CompactMobile renders scalar attributes inline as "key=val · key2=val2"
+	// instead of a JSON code block, which is easier to read on narrow screens.
+	// Attributes containing groups still fall back to the JSON block.
+	CompactMobile bool
+	// SeverityBadge prepends a badge summarizing the number of warnings and errors
+	// (e.g. "⚠️2 🚨1") to each batch.
+	SeverityBadge bool
+	// MaxBufferedBytes caps the total size of buffered log content.
+	// When exceeded, the oldest records are dropped and a warning with the number of
+	// dropped records and when they were dropped is posted with the next batch. Zero means no limit.
+	MaxBufferedBytes int
+	// ShowLevelText adds the level name (e.g. "ERROR") after the level stamp.
+	ShowLevelText bool
+	// LevelNames overrides the level names shown by ShowLevelText.
+	// Levels not in the map use [slog.Level.String].
+	LevelNames map[slog.Level]string
+	// DailySummary posts the number of records handled per level once a day
+	// at DailySummaryHour (local time).
+	DailySummary     bool
+	DailySummaryHour int
+	// KeyUnits maps attribute keys to a unit suffix appended to their values,
+	// e.g. {"latency_ms": "ms"} renders latency_ms=120 as "120ms".
+	KeyUnits map[string]string
+	// Middleware is applied in order to each record before it is formatted.
+	// It can add or remove attributes, change the message, or adjust the level.
+	Middleware []func(ctx context.Context, r slog.Record) slog.Record
+	// NeutralizeChannelLinks escapes "#" in the message so that text like "#general"
+	// is not rendered as a channel link. Attributes are left untouched.
+	NeutralizeChannelLinks bool
+	// ThreadByFingerprint groups recurring errors: the first Error-level record with a given
+	// message and source is posted on its own, and recurrences are posted as replies citing it.
+	ThreadByFingerprint bool
+	// FlushAfterErrors flushes the buffer as soon as this many Error-level records
+	// have accumulated, instead of waiting for the next tick. Zero disables it.
+	FlushAfterErrors int
+	// AttrFormat selects the format of the attribute code block. Defaults to JSON.
+	AttrFormat AttrFormat
+	// TailBuffer keeps the newest N records buffered on each periodic flush so that
+	// they are coalesced with the next batch. Remaining records are sent on Close.
+	TailBuffer int
+	// DetectCodeLang renders top-level string attributes that look like SQL, JSON,
+	// or a Go stack trace in their own code block tagged with the detected language.
+	DetectCodeLang bool
+	// ShowGaps prepends a line like "⏱ 5m since last log" to a batch when more than
+	// this duration has elapsed since the previous batch. Zero disables it.
+	ShowGaps time.Duration
+	// Suppress drops records for which it returns true before they are formatted.
+	// Suppressed records are counted in [Stats].
+	Suppress func(r slog.Record) bool
+	// SingleMessagePerFlush guarantees one message per channel on each flush: a batch
+	// longer than traQ's message limit is uploaded as a file and linked from a short summary.
+	SingleMessagePerFlush bool
+	// LevelBotTokens posts records of the given levels with a different bot token,
+	// e.g. to let an "alerts" bot post errors. Other levels use BotToken.
+	LevelBotTokens map[slog.Level]string
+	// ArraysAsBullets renders top-level slice attributes as markdown bullet lists
+	// under their key instead of inside the attribute code block.
+	ArraysAsBullets bool
+	// FlushDeadline caps the total time of a single flush across all sends.
+	// Records not sent before the deadline are re-buffered for the next flush
+	// and the failure is reported to OnInternalError. Zero means no deadline.
+	FlushDeadline time.Duration
+	// StampPosition places the level stamp before (default) or after the message.
+	StampPosition StampPosition
+	// IncludeErrorType adds a "<key>_type" attribute with the concrete type
+	// (e.g. "*net.OpError") next to each error-valued attribute.
+	IncludeErrorType bool
+	// MinInterMessageDelay spaces successive posts by at least this duration
+	// to avoid notification bursts. Zero disables throttling.
+	MinInterMessageDelay time.Duration
+	// MaxSendsPerMinute limits the number of posts per minute to each channel.
+	// Batches for a channel over its limit stay buffered without delaying other channels.
+	// Zero means no limit.
+	MaxSendsPerMinute int
+	// BeforeFlush is called synchronously with the content of each message right before it is sent.
+	// It only observes the content, e.g. to duplicate it to another sink.
+	BeforeFlush func(content string)
+	// LargeIntAsString renders integers outside the range JavaScript can represent exactly
+	// (±2^53-1) as strings, so that JSON consumers do not lose precision.
+	LargeIntAsString bool
+	// MentionRolesByLevel mentions traQ groups (e.g. "oncall") in the header of records at the given levels.
+	// Setting it makes traQ embed mentions in posted messages, which also applies to
+	// "@name" and "#channel" text in log messages.
+	MentionRolesByLevel map[slog.Level][]string
+	// MaxAttrsBytes limits the size of the serialized attribute block. When exceeded,
+	// the largest top-level attributes are dropped until it fits, and the number of
+	// dropped attributes is added as "_truncated" so the block stays valid JSON.
+	// Zero means no limit.
+	MaxAttrsBytes int
+	// NormalizeNewlines converts "\r\n" and "\r" in the message to "\n".
+	NormalizeNewlines bool
+	// MinimalHeader renders the header as "INFO 12:00:00 message", without the level stamp or brackets.
+	MinimalHeader bool
+	// AttachFullRecordOnError attaches a JSON file with the complete record
+	// (level, time, message, source, and all attributes) to each Error-level record.
+	AttachFullRecordOnError bool
+	// NowFunc, if set, provides the time of records that have none.
+	NowFunc func() time.Time
+	// StackTraceLevel attaches the goroutine's stack trace to records at or above this level.
+	// Nil disables stack traces.
+	StackTraceLevel slog.Leveler
+	// InlineTopFrame shows the top application frame of an attached stack trace
+	// in the header, e.g. "(at main.run main.go:42)".
+	InlineTopFrame bool
+	// FlushJitter delays each periodic flush by a random duration in [0, FlushJitter)
+	// so that many instances do not post at the same moment.
+	FlushJitter time.Duration
+	// Rand is the random source used for FlushJitter. Nil uses the global source.
+	Rand *rand.Rand
+	// OnEncodeError returns the content that replaces the attribute block when attrs
+	// cannot be encoded as JSON. By default, attrs are written with fmt in a text block.
+	OnEncodeError func(err error, attrs map[string]any) string
+	// BusinessHours restricts posting of non-error records to the given daily range.
+	// Outside of it, they are written to FallbackWriter instead. Nil means always.
+	BusinessHours *BusinessHours
+	// FallbackWriter receives formatted records that are not posted to traQ.
+	FallbackWriter io.Writer
+	// JSONKeyNormalizer rewrites attribute keys in the attribute code block (JSON or YAML).
+	JSONKeyNormalizer func(key string) string
+	// InlineKeyNormalizer rewrites attribute keys rendered inline by CompactMobile.
+	InlineKeyNormalizer func(key string) string
+	// ErrorMirrorChannelID is a channel that additionally receives every Error-level record immediately,
+	// while the record is still batched to its normal channel.
+	ErrorMirrorChannelID string
+	// ErrorContextLines prepends the contents of the last N records preceding an
+	// Error-level record to it in a text code block, to show what led up to the error.
+	ErrorContextLines int
+	// FlattenGroupNames lists groups rendered as dotted keys like "req.id"
+	// instead of nested objects. Other groups stay nested.
+	FlattenGroupNames []string
+	// AutoDeleteAfter deletes each posted message once this duration has passed,
+	// for ephemeral debug logs. Zero keeps messages.
+	AutoDeleteAfter time.Duration
+	// JSONMirrorWriter additionally receives every record as a line of JSON,
+	// so that machines can parse what humans read in the channel.
+	JSONMirrorWriter io.Writer
+	// PinKey is the key of an attribute that pins the posted message when its value is
+	// true or a string like "true", e.g. for deploy markers. Such records are posted on their own.
+	PinKey string
+	// MaxRecordAge forces a flush of the whole buffer once its oldest record has waited
+	// this long, bounding latency regardless of the other flush triggers. Zero disables it.
+	MaxRecordAge time.Duration
+	// Environment, such as "staging", and Name, such as the application name, are rendered
+	// as a badge like `staging/api` at the start of each record to tell deployments apart.
+	Environment string
+	Name        string
+	// ErrorsFirst orders each batch by severity, highest first,
+	// keeping the arrival order of records with the same level.
+	ErrorsFirst bool
+	// BlockSeparator is inserted between the message and the attribute code block,
+	// e.g. "\n\n" for a blank line. Defaults to "\n".
+	BlockSeparator string
+	// ReviewMode posts all records to ReviewChannelID instead of ChannelID or the channel
+	// they are routed to, so that logs for sensitive channels can be reviewed by a human
+	// first. Promoting reviewed messages to their channel is left to the reviewer.
+	ReviewMode      bool
+	ReviewChannelID string
+	// LatencyFromKey is the key of a time.Time attribute holding when an operation started.
+	// Records carrying it have the elapsed time appended to the message, like "(took 100ms)".
+	LatencyFromKey string
+	// BytesRender selects how []byte attributes are rendered. Defaults to base64.
+	BytesRender BytesRender
+	// ChannelOverrideKey is the key of a string attribute whose value replaces the
+	// destination channel of the record. The attribute itself is not rendered.
+	ChannelOverrideKey string
+	// WrapWidth soft-wraps the message at this column on word boundaries.
+	// Attributes and code blocks are not wrapped. Zero disables it.
+	WrapWidth int
+	// ErrorDigestOnClose posts a digest of the distinct Error-level messages seen
+	// during the run, with their counts, after the final flush on Close.
+	ErrorDigestOnClose bool
+	// PriorityKey is the key of an integer attribute giving the priority of the record.
+	// A record with a positive priority flushes the buffer as soon as it is handled,
+	// and batches are ordered by priority, highest first.
+	PriorityKey string
+	// TableOfContents prepends a numbered list of the record messages to batches
+	// of more than one record, and prefixes each entry with its number, like "[2]".
+	TableOfContents bool
+	// DedupWindow drops records with the same fingerprint as a record handled less than
+	// this long ago. Dropped records are counted in [Stats]. Zero disables it.
+	DedupWindow time.Duration
+	// FingerprintFunc defines which records are the same for DedupWindow and
+	// ThreadByFingerprint. Defaults to the message and source location.
+	FingerprintFunc func(r slog.Record) string
+	// DefaultStamp is the stamp of levels other than Debug, Info, Warn and Error.
+	// Defaults to ":question:".
+	DefaultStamp string
+	// Heartbeat posts a heartbeat on a periodic flush with nothing to send once this long
+	// has passed since the last batch or heartbeat, so that silence means the process is down.
+	// Zero disables it.
+	Heartbeat time.Duration
+	// HeartbeatContent returns the content of a heartbeat given the counters accumulated
+	// since the previous heartbeat. Defaults to ":heartbeat: alive".
+	HeartbeatContent func(stats Stats) string
+	// LevelDelivery selects per level whether records wait for the next periodic flush
+	// or flush the buffer as soon as they are handled. Levels not in the map are batched
+	// unless ImmediateLevel says otherwise.
+	LevelDelivery map[slog.Level]DeliveryMode
+	// ImmediateLevel flushes the buffer as soon as a record at or above this level is
+	// handled, instead of waiting for the next periodic flush. Nil batches all levels.
+	ImmediateLevel slog.Leveler
+	// SplitFunc splits content longer than traQ's message limit of max characters, or
+	// MaxMessageBytes if smaller, into chunks that are posted as separate messages.
+	// Defaults to splitting at newlines, closing and reopening code blocks across chunks.
+	// Batches are split between records first, so content is a single record too long
+	// by itself, unless SingleMessagePerFlush is set and it is the whole batch.
+	SplitFunc func(content string, max int) []string
+	// ReactByLevel maps levels to stamp IDs. The message of each batch gets the stamp
+	// of the highest level in the batch, so that the channel can be filtered by stamp.
+	ReactByLevel map[slog.Level]string
+	// DegradeAfterFailures switches to writing records to FallbackWriter after this many
+	// consecutive failed sends. traQ is probed periodically with a message reporting the
+	// outage, and posting resumes once it succeeds. Zero disables it.
+	DegradeAfterFailures int
+	// FlushInterval is the period of the periodic flush. Defaults to one second.
+	FlushInterval time.Duration
+	// MaxMessageBytes limits the size of each posted message in bytes, in addition to
+	// traQ's limit in characters. Batches are split between records to fit, and records
+	// too long by themselves are split without breaking code blocks. Zero means no limit.
+	MaxMessageBytes int
+	// MaxBatchCount flushes the buffer as soon as this many records are buffered,
+	// instead of waiting for the next flush. Zero disables it.
+	MaxBatchCount int
+	// MaxRetries re-buffers the records of a failed send to be sent again with the next
+	// flush, up to this many times before giving up. Flushes are held back meanwhile by
+	// RetryBackoff, doubled with each attempt, plus a random jitter of up to half of it.
+	// Zero disables retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry. Defaults to one second.
+	RetryBackoff time.Duration
+	// Fallback receives the original records of sends that fail for good, after any retries,
+	// e.g. a slog.JSONHandler writing to stderr. Attributes and groups added with WithAttrs
+	// and WithGroup are passed on to it.
+	Fallback slog.Handler
+	// QueueSize is the capacity of the queue between Handle and the send loop. Defaults to 10.
+	QueueSize int
+	// Overflow is what Handle does when the queue is full. Defaults to blocking until there is room.
+	Overflow OverflowPolicy
+	// ChannelByLevel maps levels to the channel their records are posted to instead of
+	// ChannelID, e.g. to keep Warn and Error apart from noisy Debug and Info records.
+	// Records for each channel are batched separately.
+	ChannelByLevel map[slog.Level]string
+	// ChannelResolver returns the channel each record is posted to, e.g. by a tenant ID
+	// attribute or a context value. An empty result falls back to ChannelByLevel and ChannelID.
+	// ChannelOverrideKey still takes precedence.
+	ChannelResolver func(ctx context.Context, r slog.Record) string
+	// AddSource appends the source location of the log call to the header,
+	// as `pkg/file.go:123 (pkg.Func)`, like slog.HandlerOptions.AddSource.
+	AddSource bool
+	// SourceLinkBase, e.g. "https://github.com/owner/repo/blob/<commit>", renders the source
+	// location of AddSource as a link to the line, given by the file path relative to SourceRoot.
+	SourceLinkBase string
+	// SourceRoot is the prefix removed from source file paths for SourceLinkBase, usually the
+	// repository's directory at build time. Defaults to the main module path, which prefixes
+	// the paths of binaries built with -trimpath. Files outside of it are not linked.
+	SourceRoot string
+	// ReplaceAttr rewrites each non-group attribute before it is rendered, like the
+	// function of slog.HandlerOptions: groups are the names of its enclosing groups, and
+	// returning a zero Attr drops it. It is not called for the time, level, and message.
+	ReplaceAttr func(groups []string, a slog.Attr) slog.Attr
+	// RedactKeys are attribute keys, such as "password" or "authorization", whose values are
+	// replaced with "[REDACTED]" wherever they appear, including groups. Keys match regardless
+	// of case. RedactKeyPatterns redacts the attributes whose keys match any of the patterns.
+	RedactKeys        []string
+	RedactKeyPatterns []*regexp.Regexp
+	// ScrubPatterns replaces matches in the rendered records, including messages and attribute
+	// values of any type, with "[REDACTED]", to catch secrets in free-form text. See DefaultScrubPatterns.
+	ScrubPatterns []*regexp.Regexp
+	// FirstFlushImmediate sends the first record as soon as it is handled
+	// instead of waiting for the first tick. Later records are batched as usual.
+	FirstFlushImmediate bool
 }
 
+// BusinessHours is a daily time range in local time, given as offsets from midnight.
+// A range whose End is before its Start spans midnight.
+type BusinessHours struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Contains reports whether t falls within the business hours.
+func (b BusinessHours) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if b.Start <= b.End {
+		return b.Start <= offset && offset < b.End
+	}
+	return offset >= b.Start || offset < b.End
+}
+
+// StampPosition is the position of the level stamp in the header.
+type StampPosition int
+
+const (
+	StampPrefix StampPosition = iota
+	StampSuffix
+)
+
+// AttrFormat is the format used to render attributes in the code block.
+type AttrFormat int
+
+const (
+	AttrFormatJSON AttrFormat = iota
+	AttrFormatYAML
+)
+
+// DeliveryMode is when records are sent to traQ.
+type DeliveryMode int
+
+const (
+	DeliveryBatched DeliveryMode = iota
+	DeliveryImmediate
+)
+
+// OverflowPolicy is what Handle does when the queue to the send loop is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until there is room in the queue.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the record being handled.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued record to make room.
+	OverflowDropOldest
+)
+
+// BytesRender is the rendering of []byte attribute values.
+type BytesRender int
+
+const (
+	BytesRenderBase64 BytesRender = iota
+	BytesRenderHex
+	// BytesRenderTruncated renders the first bytes in hex followed by the total length.
+	BytesRenderTruncated
+)
+
+// truncatedBytesLength is the number of bytes shown by BytesRenderTruncated.
+const truncatedBytesLength = 16
+
 type Handler struct {
-	client messageSender
+	client Sender
 	opt    Option
-	ch     chan string
+	ch     chan message
+	stats  *handlerStats
+	// ctrl runs functions on the sendMessageLoop goroutine with access to its buffer.
+	ctrl chan func(buf *sendBuffer)
+	// done is closed when sendMessageLoop exits.
+	done chan struct{}
+	// disabled mutes the handler at runtime, see Enable.
+	disabled *atomic.Bool
+	// shutdown guards closing ch and carries the result of the final flush.
+	shutdown *shutdownState
+	// stamps overrides the default level stamps, see LoadStamps.
+	stamps *atomic.Pointer[map[slog.Level]string]
+	// dedup tracks fingerprints for Option.DedupWindow.
+	dedup *dedupCache
 
 	groups []string
 	attrs  map[string]any
 	cur    map[string]any
+	// fallback is Option.Fallback with the attributes and groups of the handler.
+	fallback slog.Handler
+	// channel is the channel set by a Channel attribute passed to WithAttrs.
+	channel string
+
+	// threads maps error fingerprints to the ID of their root message.
+	// It is owned by the sendMessageLoop goroutine.
+	threads map[string]string
+	// lastFlush is the time the previous batch was flushed.
+	// It is owned by the sendMessageLoop goroutine.
+	lastFlush time.Time
+	// lastPost is the time the previous message was posted.
+	// It is owned by the sendMessageLoop goroutine.
+	lastPost time.Time
+	// limiter paces posts per channel. It is owned by the sendMessageLoop goroutine.
+	limiter *channelLimiter
+	// failures is the number of consecutive failed sends, lastProbe is when traQ was last
+	// probed in degraded mode, and diverted is the number of records written to the
+	// fallback writer since. They are owned by the sendMessageLoop goroutine.
+	failures  int
+	lastProbe time.Time
+	diverted  int
+	// retryAt is when flushes resume after a failed send is re-buffered for a retry,
+	// and closing disables retries for the final flush.
+	// They are owned by the sendMessageLoop goroutine.
+	retryAt time.Time
+	closing bool
 }
 
 var _ slog.Handler = (*Handler)(nil)
@@ -37,219 +439,2909 @@ var _ slog.Handler = (*Handler)(nil)
 // New creates a new Handler and starts a background goroutine for log transmission.
 // Ensure Close() is called when the application shuts down to flush remaining logs.
 func New(client *traq.APIClient, option Option) *Handler {
+	return NewWithSender(&traQClientWrapper{
+		client: client,
+		token:  option.BotToken,
+		embed:  len(option.MentionRolesByLevel) > 0,
+	}, option)
+}
+
+// NewWithSender creates a new Handler that posts through s instead of the traQ API client.
+// Features that need other traQ APIs, such as threading, attachments, pins, stamps and
+// deletion, are only available with New. Option.BotToken is not used, while the tokens of
+// Option.LevelBotTokens are passed to s in the context under [traq.ContextAccessToken].
+func NewWithSender(s Sender, option Option) *Handler {
 	attrs := make(map[string]any)
 	h := &Handler{
-		client: &traQClientWrapper{
-			client:    client,
-			token:     option.BotToken,
-			channelID: option.ChannelID,
-		},
-		opt: option,
-		ch:  make(chan string, 10),
+		client: s,
+		opt:    option,
+		ch:     make(chan message, cmp.Or(max(option.QueueSize, 0), 10)),
+		stats:  new(handlerStats),
+		ctrl:   make(chan func(*sendBuffer)),
+		done:   make(chan struct{}),
 
-		attrs: attrs,
-		cur:   attrs,
+		disabled: new(atomic.Bool),
+
+		shutdown: new(shutdownState),
+		stamps:   new(atomic.Pointer[map[slog.Level]string]),
+		dedup:    new(dedupCache),
+
+		attrs:    attrs,
+		cur:      attrs,
+		fallback: option.Fallback,
+
+		threads: make(map[string]string),
+		limiter: newChannelLimiter(option.MaxSendsPerMinute),
 	}
 	go h.sendMessageLoop()
 	return h
 }
 
 // Close closes the internal log channel and stops the background transmission loop.
-// Any pending logs in the channel are flushed to traQ before exiting.
+// Any pending logs in the channel are flushed to traQ before exiting. Records handled
+// afterwards are passed to Option.Fallback if set, and counted in [Stats] as dropped.
+// It is safe to call Close more than once, concurrently, and on any derived handler.
 func (h *Handler) Close() {
-	close(h.ch)
+	h.close(context.Background())
+}
+
+// Shutdown is like Close, but waits for the pending logs to be flushed and returns
+// the errors of failed sends. ctx bounds the final flush, and Shutdown returns the
+// error of ctx if it is done before the flush finishes.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.close(ctx)
+	select {
+	case <-h.done:
+		return h.shutdown.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdownState is shared by a Handler and its derived handlers.
+type shutdownState struct {
+	once sync.Once
+	// mu guards closed. Sends on ch hold it for reading, so that ch is not closed meanwhile.
+	mu     sync.RWMutex
+	closed bool
+	// ctx bounds the final flush. It is set before ch is closed.
+	ctx context.Context
+	// err is the result of the final flush. It is set before done is closed.
+	err error
+}
+
+func (h *Handler) close(ctx context.Context) {
+	h.shutdown.once.Do(func() {
+		h.shutdown.mu.Lock()
+		defer h.shutdown.mu.Unlock()
+		h.shutdown.closed = true
+		h.shutdown.ctx = ctx
+		close(h.ch)
+	})
+}
+
+// Flush sends the records handled so far without waiting for the next periodic flush.
+// It returns the errors of failed sends, or the error of ctx if ctx is done first;
+// records that could not be sent before then stay buffered.
+func (h *Handler) Flush(ctx context.Context) error {
+	result := make(chan error, 1)
+	if err := h.requestFlush(ctx, &flushRequest{ctx: ctx, result: result}); err != nil {
+		return err
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Enable turns delivery on or off at runtime. While disabled, Enabled reports false
+// and records passed to Handle are dropped and counted in [Stats].
+// It affects the handler and all handlers derived from it.
+func (h *Handler) Enable(enabled bool) {
+	h.disabled.Store(!enabled)
 }
 
 func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
-	return level >= h.opt.Level.Level()
+	return !h.disabled.Load() && level >= h.opt.Level.Level()
 }
 
-func (h *Handler) Handle(_ context.Context, record slog.Record) error {
-	h.ch <- h.generateMessageContent(record)
+func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
+	if h.disabled.Load() {
+		h.stats.disabled.Add(1)
+		return nil
+	}
+	for _, mw := range h.opt.Middleware {
+		record = mw(ctx, record)
+	}
+	if record.Time.IsZero() && h.opt.NowFunc != nil {
+		record.Time = h.opt.NowFunc()
+	}
+	if h.opt.Suppress != nil && h.opt.Suppress(record) {
+		h.stats.suppressed.Add(1)
+		return nil
+	}
+	if h.opt.DedupWindow > 0 && h.dedup.seen(h.fingerprint(record), time.Now(), h.opt.DedupWindow) {
+		h.stats.deduplicated.Add(1)
+		return nil
+	}
+	h.stats.countLevel(record.Level)
+	msg := message{
+		level:   record.Level,
+		channel: h.channelID(),
+	}
+	if channel, ok := h.opt.ChannelByLevel[record.Level]; ok {
+		msg.channel = channel
+	}
+	if h.opt.ChannelResolver != nil {
+		if channel := h.opt.ChannelResolver(ctx, record); channel != "" {
+			msg.channel = channel
+		}
+	}
+	if h.channel != "" {
+		msg.channel = h.channel
+	}
+	var channel string
+	record, channel = h.extractChannelOverride(record)
+	if channel != "" {
+		msg.channel = channel
+	}
+	if h.opt.ReviewMode {
+		// routing applies to the channel after review
+		msg.channel = h.opt.ReviewChannelID
+	}
+	msg.content = h.generateMessageContent(record)
+	if h.opt.StackTraceLevel != nil && record.Level >= h.opt.StackTraceLevel.Level() {
+		msg.content = h.appendStackTrace(msg.content, captureStack())
+	}
+	if h.opt.TableOfContents || h.opt.ErrorDigestOnClose && record.Level >= slog.LevelError {
+		msg.text = h.scrub(record.Message)
+	}
+	if h.opt.ThreadByFingerprint && record.Level >= slog.LevelError {
+		msg.fingerprint = h.fingerprint(record)
+	}
+	if h.opt.PinKey != "" {
+		msg.pin = h.hasPinMarker(record)
+	}
+	if h.opt.PriorityKey != "" {
+		msg.priority = h.priority(record)
+	}
+	if h.opt.AttachFullRecordOnError && record.Level >= slog.LevelError {
+		msg.attachment = h.recordDump(record)
+	}
+	if h.opt.BusinessHours != nil && record.Level < slog.LevelError && !h.opt.BusinessHours.Contains(time.Now()) {
+		msg.divert = true
+	}
+	if h.opt.JSONMirrorWriter != nil {
+		msg.jsonLine = h.recordLine(record)
+	}
+	if h.fallback != nil {
+		msg.original = &originalRecord{h: h.fallback, r: record.Clone()}
+	}
+	h.enqueue(msg)
 	return nil
 }
 
-func (h *Handler) generateMessageContent(r slog.Record) string {
-	var content bytes.Buffer
+// enqueue passes msg to the send loop according to Option.Overflow.
+func (h *Handler) enqueue(msg message) {
+	h.shutdown.mu.RLock()
+	defer h.shutdown.mu.RUnlock()
+	if h.shutdown.closed {
+		h.stats.drops.add(1, time.Now())
+		h.handToFallback(context.Background(), msg)
+		return
+	}
+	switch h.opt.Overflow {
+	case OverflowDropNewest:
+		select {
+		case h.ch <- msg:
+		default:
+			h.stats.overflowed.Add(1)
+			h.stats.drops.add(1, time.Now())
+		}
+		return
+	case OverflowDropOldest:
+		for {
+			select {
+			case h.ch <- msg:
+				return
+			default:
+			}
+			select {
+			case old := <-h.ch:
+				if old.flush != nil {
+					// requeue the flush request, which Flush is waiting for
+					h.ch <- old
+					continue
+				}
+				h.stats.overflowed.Add(1)
+				h.stats.drops.add(1, time.Now())
+			default:
+			}
+		}
+	}
+	h.ch <- msg
+}
+
+// captureStack returns the frames of the calling goroutine, excluding the runtime,
+// log/slog, and this handler's methods.
+func captureStack() []runtime.Frame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var stack []runtime.Frame
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") &&
+			!strings.HasPrefix(frame.Function, "log/slog.") &&
+			!strings.HasPrefix(frame.Function, "github.com/pirosiki197/slog-traq.(*Handler).") {
+			stack = append(stack, frame)
+		}
+		if !more {
+			return stack
+		}
+	}
+}
 
-	// level
-	content.WriteString(writeLevelStamp(r.Level))
-	content.WriteByte(' ')
-	// time
-	if !r.Time.IsZero() {
-		content.WriteString("[")
-		content.WriteString(r.Time.Format(time.DateTime))
-		content.WriteString("] ")
+// appendStackTrace adds stack to the formatted content, optionally showing the top frame in the header.
+func (h *Handler) appendStackTrace(content string, stack []runtime.Frame) string {
+	if len(stack) == 0 {
+		return content
+	}
+	if h.opt.InlineTopFrame {
+		top := stack[0]
+		header, rest, found := strings.Cut(content, "\n")
+		header += fmt.Sprintf(" (at %s %s:%d)", top.Function, path.Base(top.File), top.Line)
+		if found {
+			content = header + "\n" + rest
+		} else {
+			content = header
+		}
 	}
-	// message
-	content.WriteString(r.Message)
 
-	// attributes
+	var b strings.Builder
+	b.WriteString(content)
+	b.WriteString("\n```text\n")
+	for _, frame := range stack {
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+	}
+	b.WriteString("```")
+	return b.String()
+}
+
+// channelAttr is the value of an attribute created by Channel.
+type channelAttr string
+
+// Channel returns an attribute that posts the record carrying it to the channel with
+// the given ID instead of the configured one, e.g. for audit events. Passed to With,
+// it applies to all records of the logger. The attribute itself is not rendered.
+func Channel(channelID string) slog.Attr {
+	return slog.Any("channel", channelAttr(channelID))
+}
+
+// channelOf returns the channel of a, if it was created by Channel.
+func channelOf(a slog.Attr) (string, bool) {
+	if a.Value.Kind() != slog.KindAny {
+		return "", false
+	}
+	channel, ok := a.Value.Any().(channelAttr)
+	return string(channel), ok
+}
+
+// isChannelOverride reports whether a is an attribute created by Channel
+// or the Option.ChannelOverrideKey attribute.
+func (h *Handler) isChannelOverride(a slog.Attr) bool {
+	if _, ok := channelOf(a); ok {
+		return true
+	}
+	return h.opt.ChannelOverrideKey != "" && a.Key == h.opt.ChannelOverrideKey
+}
+
+// extractChannelOverride returns r without its channel override attributes, see isChannelOverride,
+// and the channel named by the last one.
+func (h *Handler) extractChannelOverride(r slog.Record) (slog.Record, string) {
+	var channel string
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		found = h.isChannelOverride(a)
+		return !found
+	})
+	if !found {
+		return r, ""
+	}
+	stripped := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		if !h.isChannelOverride(a) {
+			stripped.AddAttrs(a)
+		} else if c, ok := channelOf(a); ok {
+			channel = c
+		} else if v := a.Value.Resolve(); v.Kind() == slog.KindString {
+			channel = v.String()
+		}
+		return true
+	})
+	return stripped, channel
+}
+
+// hasPinMarker reports whether r or the handler carries a truthy Option.PinKey attribute.
+func (h *Handler) hasPinMarker(r slog.Record) bool {
+	truthy := func(v any) bool {
+		switch v := v.(type) {
+		case bool:
+			return v
+		case string:
+			b, _ := strconv.ParseBool(v)
+			return b
+		}
+		return false
+	}
+	found := truthy(h.attrs[h.opt.PinKey])
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == h.opt.PinKey {
+			found = truthy(a.Value.Resolve().Any())
+		}
+		return true
+	})
+	return found
+}
+
+// priority returns the value of the Option.PriorityKey attribute of r, or zero.
+func (h *Handler) priority(r slog.Record) int64 {
+	var p int64
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key != h.opt.PriorityKey {
+			return true
+		}
+		switch v := a.Value.Resolve(); v.Kind() {
+		case slog.KindInt64:
+			p = v.Int64()
+		case slog.KindUint64:
+			p = int64(min(v.Uint64(), math.MaxInt64))
+		}
+		return false
+	})
+	return p
+}
+
+// recordEntry is everything known about a record, as serialized to JSON.
+type recordEntry struct {
+	Level   slog.Level     `json:"level"`
+	Time    time.Time      `json:"time"`
+	Message string         `json:"message"`
+	Source  *recordSource  `json:"source,omitempty"`
+	Attrs   map[string]any `json:"attrs"`
+}
+
+type recordSource struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+func (h *Handler) newRecordEntry(r slog.Record) recordEntry {
+	entry := recordEntry{
+		Level:   r.Level,
+		Time:    r.Time,
+		Message: r.Message,
+	}
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		entry.Source = &recordSource{Function: frame.Function, File: frame.File, Line: frame.Line}
+	}
 	attrs, cur := h.extractMap()
 	r.Attrs(func(a slog.Attr) bool {
-		appendAttr(cur, a)
+		h.appendAttr(cur, h.groups, a)
 		return true
 	})
-	if len(attrs) > 0 {
-		content.WriteString("\n```json\n")
-		encoder := json.NewEncoder(&content)
-		encoder.SetIndent("", "  ")
-		encoder.Encode(attrs)
-		content.WriteString("```")
+	entry.Attrs = attrs
+	return entry
+}
+
+// recordDump serializes everything known about r as indented JSON.
+func (h *Handler) recordDump(r slog.Record) []byte {
+	b, err := json.MarshalIndent(h.newRecordEntry(r), "", "  ")
+	if err != nil {
+		h.reportError(err)
+		return nil
 	}
+	return h.scrubBytes(b)
+}
 
-	return content.String()
+// recordLine serializes everything known about r as a single line of JSON.
+func (h *Handler) recordLine(r slog.Record) []byte {
+	b, err := json.Marshal(h.newRecordEntry(r))
+	if err != nil {
+		h.reportError(err)
+		return nil
+	}
+	return append(h.scrubBytes(b), '\n')
 }
 
-func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	h2 := h.clone()
-	for _, attr := range attrs {
-		appendAttr(h2.cur, attr)
+// source returns the location of pc as the file with its directory, the line, and the function.
+// The file and line link to Option.SourceLinkBase if set.
+func (h *Handler) source(pc uintptr) string {
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	dir, file := path.Split(frame.File)
+	function := frame.Function
+	if i := strings.LastIndexByte(function, '/'); i >= 0 {
+		function = function[i+1:]
 	}
-	return h2
+	location := fmt.Sprintf("%s:%d", path.Join(path.Base(dir), file), frame.Line)
+	if h.opt.SourceLinkBase != "" {
+		root := h.opt.SourceRoot
+		if root == "" {
+			root = mainModulePath()
+		}
+		if rel, ok := strings.CutPrefix(frame.File, strings.TrimSuffix(root, "/")+"/"); ok && root != "" {
+			location = fmt.Sprintf("[%s](%s/%s#L%d)", location, strings.TrimSuffix(h.opt.SourceLinkBase, "/"), rel, frame.Line)
+		}
+	}
+	return fmt.Sprintf("%s (%s)", location, function)
 }
 
-func appendAttr(m map[string]any, attr slog.Attr) {
-	attr.Value = attr.Value.Resolve()
-	if attr.Value.Kind() != slog.KindGroup {
-		m[attr.Key] = attr.Value.Any()
-		return
+// mainModulePath returns the path of the main module, or "" if unknown.
+var mainModulePath = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
 	}
+	return info.Main.Path
+})
 
-	if len(attr.Value.Group()) == 0 {
-		return
+// fingerprint identifies recurrences of the same record using Option.FingerprintFunc,
+// or by its message and source location.
+func (h *Handler) fingerprint(r slog.Record) string {
+	if h.opt.FingerprintFunc != nil {
+		return h.opt.FingerprintFunc(r)
 	}
+	frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+	return fmt.Sprintf("%s:%d:%s", frame.File, frame.Line, r.Message)
+}
 
-	if attr.Key == "" {
-		// inline group
-		maps.Copy(m, convertGroupToMap(attr.Value))
-	} else {
-		m[attr.Key] = convertGroupToMap(attr.Value)
+// maxDedupEntries is the number of fingerprints above which expired ones are swept.
+const maxDedupEntries = 1024
+
+// dedupCache remembers when each fingerprint was last let through.
+type dedupCache struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// seen reports whether fp was let through less than window before now,
+// and otherwise lets it through at now.
+func (c *dedupCache) seen(fp string, now time.Time, window time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if last, ok := c.last[fp]; ok && now.Sub(last) < window {
+		return true
+	}
+	if c.last == nil {
+		c.last = make(map[string]time.Time)
+	}
+	if len(c.last) >= maxDedupEntries {
+		maps.DeleteFunc(c.last, func(_ string, last time.Time) bool {
+			return now.Sub(last) >= window
+		})
 	}
+	c.last[fp] = now
+	return false
 }
 
-func (h *Handler) WithGroup(name string) slog.Handler {
-	h2 := h.clone()
-	h2.groups = append(h2.groups, name)
-	newMap := make(map[string]any)
-	h2.cur[name] = newMap
-	h2.cur = newMap
-	return h2
+// Stats is a snapshot of the handler's counters.
+type Stats struct {
+	// Suppressed is the number of records dropped by Option.Suppress.
+	Suppressed uint64
+	// Disabled is the number of records dropped while the handler was disabled by Enable.
+	Disabled uint64
+	// Deduplicated is the number of records dropped by Option.DedupWindow.
+	Deduplicated uint64
+	// Overflowed is the number of records dropped by Option.Overflow because the queue was full.
+	Overflowed uint64
+	// Dropped is the number of records dropped because the queue or the buffer was full,
+	// including Overflowed, or because the handler was closed. Each flush reports the records dropped since the previous one.
+	Dropped uint64
+	// Sent is the number of messages posted to traQ.
+	Sent uint64
+	// Throttled is the number of posts rejected by traQ's rate limit.
+	Throttled uint64
+	// ThrottledUntil is when sending resumes after the latest rate limit.
+	// Sending is paused while it is in the future.
+	ThrottledUntil time.Time
+	// ByLevel is the number of records handled at each level.
+	ByLevel map[slog.Level]uint64
 }
 
-func (h *Handler) clone() *Handler {
-	attrs, cur := h.extractMap()
-	return &Handler{
-		client: h.client,
-		opt:    h.opt,
-		ch:     h.ch,
+// handlerStats holds the counters shared by a Handler and its derived handlers.
+type handlerStats struct {
+	suppressed   atomic.Uint64
+	disabled     atomic.Uint64
+	deduplicated atomic.Uint64
+	overflowed   atomic.Uint64
+	drops        dropCounter
+	sent         atomic.Uint64
+	throttled    atomic.Uint64
+	// throttledUntil is Stats.ThrottledUntil in Unix nanoseconds.
+	throttledUntil atomic.Int64
+
+	mu      sync.Mutex
+	byLevel map[slog.Level]uint64
+}
+
+// dropCounter counts dropped records, and when the ones not reported yet were dropped.
+type dropCounter struct {
+	mu          sync.Mutex
+	dropped     uint64
+	pending     int
+	first, last time.Time
+}
 
-		groups: slices.Clip(h.groups),
-		attrs:  attrs,
-		cur:    cur,
+func (d *dropCounter) add(n int, now time.Time) {
+	if n == 0 {
+		return
 	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dropped += uint64(n)
+	if d.pending == 0 {
+		d.first = now
+	}
+	d.pending += n
+	d.last = now
 }
 
-func (h *Handler) extractMap() (map[string]any, map[string]any) {
-	newAttrs := deepCopyMap(h.attrs)
-	newCur := newAttrs
-	for _, name := range h.groups {
-		if m, ok := newAttrs[name].(map[string]any); ok {
-			newCur = m
-		} else {
-			break
+func (d *dropCounter) total() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dropped
+}
+
+// hasPending reports whether records were dropped since the previous take.
+func (d *dropCounter) hasPending() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending > 0
+}
+
+// take returns the number of records dropped since the previous call, and when the first and the last were dropped.
+func (d *dropCounter) take() (n int, first, last time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, first, last = d.pending, d.first, d.last
+	d.pending = 0
+	return n, first, last
+}
+
+func (s *handlerStats) countLevel(level slog.Level) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.byLevel == nil {
+		s.byLevel = make(map[slog.Level]uint64)
+	}
+	s.byLevel[level]++
+}
+
+// since returns the counters accumulated after prev.
+func (s Stats) since(prev Stats) Stats {
+	d := Stats{
+		Suppressed:   s.Suppressed - prev.Suppressed,
+		Disabled:     s.Disabled - prev.Disabled,
+		Deduplicated: s.Deduplicated - prev.Deduplicated,
+		Overflowed:   s.Overflowed - prev.Overflowed,
+		Dropped:      s.Dropped - prev.Dropped,
+		Sent:         s.Sent - prev.Sent,
+		Throttled:    s.Throttled - prev.Throttled,
+		// not a counter
+		ThrottledUntil: s.ThrottledUntil,
+	}
+	for level, n := range s.ByLevel {
+		if n -= prev.ByLevel[level]; n > 0 {
+			if d.ByLevel == nil {
+				d.ByLevel = make(map[slog.Level]uint64)
+			}
+			d.ByLevel[level] = n
 		}
 	}
-	return newAttrs, newCur
+	return d
 }
 
-func convertGroupToMap(v slog.Value) map[string]any {
-	attrs := v.Group()
-	if len(attrs) == 0 {
-		return nil
+// Stats returns a snapshot of the handler's counters.
+// Handlers derived with WithAttrs or WithGroup share the counters of their parent.
+func (h *Handler) Stats() Stats {
+	h.stats.mu.Lock()
+	byLevel := maps.Clone(h.stats.byLevel)
+	h.stats.mu.Unlock()
+
+	var throttledUntil time.Time
+	if until := h.stats.throttledUntil.Load(); until != 0 {
+		throttledUntil = time.Unix(0, until)
 	}
-	m := make(map[string]any, len(attrs))
-	for _, a := range attrs {
-		appendAttr(m, a)
+	return Stats{
+		Suppressed:     h.stats.suppressed.Load(),
+		Disabled:       h.stats.disabled.Load(),
+		Deduplicated:   h.stats.deduplicated.Load(),
+		Overflowed:     h.stats.overflowed.Load(),
+		Dropped:        h.stats.drops.total(),
+		Sent:           h.stats.sent.Load(),
+		Throttled:      h.stats.throttled.Load(),
+		ThrottledUntil: throttledUntil,
+		ByLevel:        byLevel,
 	}
-	return m
 }
 
-func writeLevelStamp(level slog.Level) string {
-	switch level {
-	case slog.LevelDebug:
-		return ":gear:"
-	case slog.LevelInfo:
-		return ":information_source:"
-	case slog.LevelWarn:
-		return ":warning:"
-	case slog.LevelError:
-		return ":alert:"
-	default:
-		return ":question:"
+// requestFlush passes f to the send loop, or returns errClosed after Close.
+func (h *Handler) requestFlush(ctx context.Context, f *flushRequest) error {
+	h.shutdown.mu.RLock()
+	defer h.shutdown.mu.RUnlock()
+	if h.shutdown.closed {
+		return errClosed
+	}
+	select {
+	case h.ch <- message{flush: f}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (h *Handler) sendMessageLoop() {
-	var builder strings.Builder
-	ticker := time.NewTicker(time.Second)
+// errClosed is returned by methods that need the background loop after Close.
+var errClosed = errors.New("slogtraq: handler is closed")
 
-	for {
-		select {
-		case msg, ok := <-h.ch:
-			if !ok {
-				h.flush(&builder)
-				return
-			}
-			if builder.Len() > 0 {
-				builder.WriteByte('\n')
-			}
-			builder.WriteString(msg)
-		case <-ticker.C:
-			h.flush(&builder)
-		}
+// do runs f on the sendMessageLoop goroutine and waits for it to finish.
+func (h *Handler) do(f func(buf *sendBuffer)) error {
+	finished := make(chan struct{})
+	select {
+	case h.ctrl <- func(buf *sendBuffer) {
+		f(buf)
+		close(finished)
+	}:
+	case <-h.done:
+		return errClosed
 	}
+	<-finished
+	return nil
 }
 
-func (h *Handler) flush(b *strings.Builder) {
-	if b.Len() == 0 {
-		return
+// DumpState serializes the handler's configuration, the records waiting to be sent,
+// and its stats as JSON. Bot tokens are redacted. It is intended for inspection in tests.
+func (h *Handler) DumpState() ([]byte, error) {
+	type pendingMessage struct {
+		Level   slog.Level `json:"level"`
+		Channel string     `json:"channel"`
+		Content string     `json:"content"`
 	}
-	err := h.client.send(context.Background(), b.String())
-	if err != nil && h.opt.OnInternalError != nil {
-		h.opt.OnInternalError(err)
+	var pending []pendingMessage
+	err := h.do(func(buf *sendBuffer) {
+		for _, msg := range buf.msgs {
+			pending = append(pending, pendingMessage{Level: msg.level, Channel: msg.channel, Content: msg.content})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type config struct {
+		Level          string                `json:"level,omitempty"`
+		ChannelID      string                `json:"channelId"`
+		BotToken       string                `json:"botToken"`
+		LevelBotTokens map[slog.Level]string `json:"levelBotTokens,omitempty"`
+	}
+	cfg := config{
+		ChannelID: h.opt.ChannelID,
+		BotToken:  redact(h.opt.BotToken),
+	}
+	if h.opt.Level != nil {
+		cfg.Level = h.opt.Level.Level().String()
+	}
+	for level, token := range h.opt.LevelBotTokens {
+		if cfg.LevelBotTokens == nil {
+			cfg.LevelBotTokens = make(map[slog.Level]string)
+		}
+		cfg.LevelBotTokens[level] = redact(token)
 	}
-	b.Reset()
+
+	return json.Marshal(struct {
+		Config       config           `json:"config"`
+		PendingCount int              `json:"pendingCount"`
+		Pending      []pendingMessage `json:"pending"`
+		Stats        Stats            `json:"stats"`
+	}{
+		Config:       cfg,
+		PendingCount: len(pending),
+		Pending:      pending,
+		Stats:        h.Stats(),
+	})
 }
 
-func deepCopyMap(m map[string]any) map[string]any {
-	cp := make(map[string]any, len(m))
-	for k, v := range m {
-		if vm, ok := v.(map[string]any); ok {
-			cp[k] = deepCopyMap(vm)
-		} else {
-			cp[k] = v
+// PostMetrics posts metrics as a markdown table of keys and values to the channel
+// of the handler right away, bypassing the buffer.
+func (h *Handler) PostMetrics(ctx context.Context, metrics map[string]any) error {
+	var b strings.Builder
+	b.WriteString("| key | value |\n| --- | --- |")
+	for _, k := range slices.Sorted(maps.Keys(metrics)) {
+		fmt.Fprintf(&b, "\n| %s | %s |", escapeTableCell(k), escapeTableCell(fmt.Sprint(metrics[k])))
+	}
+
+	var err error
+	if doErr := h.do(func(*sendBuffer) {
+		if err = h.waitTurn(ctx); err == nil {
+			_, err = h.post(ctx, h.channelID(), b.String())
 		}
+	}); doErr != nil {
+		return doErr
 	}
-	return cp
+	return err
 }
 
-// messageSender defines the behavior of a message transmission (abstracted for testing).
-type messageSender interface {
-	send(ctx context.Context, content string) error
+func escapeTableCell(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", " ")
 }
 
-type traQClientWrapper struct {
-	client    *traq.APIClient
-	token     string
-	channelID string
+// redacted replaces hidden values.
+const redacted = "[REDACTED]"
+
+// DefaultScrubPatterns match common secrets for Option.ScrubPatterns:
+// JSON Web Tokens, AWS access key IDs, and bearer tokens.
+var DefaultScrubPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`),
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/-]+=*`),
 }
 
-func (c *traQClientWrapper) send(ctx context.Context, content string) error {
-	ctx = context.WithValue(ctx, traq.ContextAccessToken, c.token)
-	_, _, err := c.client.MessageAPI.
-		PostMessage(ctx, c.channelID).
-		PostMessageRequest(traq.PostMessageRequest{Content: content}).
-		Execute()
-	return err
+// scrub replaces the matches of Option.ScrubPatterns in s.
+func (h *Handler) scrub(s string) string {
+	for _, p := range h.opt.ScrubPatterns {
+		s = p.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+// scrubBytes is scrub for serialized records.
+func (h *Handler) scrubBytes(b []byte) []byte {
+	for _, p := range h.opt.ScrubPatterns {
+		b = p.ReplaceAll(b, []byte(redacted))
+	}
+	return b
+}
+
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// message is a formatted log record waiting to be sent.
+type message struct {
+	level   slog.Level
+	content string
+	// channel is the destination traQ channel ID.
+	channel string
+	// fingerprint is set when the message should be threaded with its recurrences.
+	fingerprint string
+	// attachment is uploaded as a file and linked from the message if set.
+	attachment []byte
+	// divert writes the message to Option.FallbackWriter instead of posting it.
+	divert bool
+	// jsonLine is written to Option.JSONMirrorWriter if set.
+	jsonLine []byte
+	// pin pins the message after it is posted on its own.
+	pin bool
+	// queued is when the message was first buffered.
+	queued time.Time
+	// original is the record for Option.Fallback if set.
+	original *originalRecord
+	// attempts is the number of failed sends of the message retried per Option.MaxRetries.
+	attempts int
+	// text is the record message, set for Option.ErrorDigestOnClose and Option.TableOfContents.
+	text string
+	// priority is the value of the Option.PriorityKey attribute.
+	priority int64
+	// flush, if set, makes the message a request to flush the buffer instead of a record.
+	flush *flushRequest
+}
+
+// flushRequest is a request by Flush to flush the buffer, bounded by ctx.
+type flushRequest struct {
+	ctx    context.Context
+	result chan error
+}
+
+// originalRecord is a record kept for the fallback handler h.
+type originalRecord struct {
+	h slog.Handler
+	r slog.Record
+}
+
+// bufferPool and attrsPool reuse the buffer and the top-level attribute map
+// allocated for each record in generateMessageContent.
+var (
+	bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+	attrsPool  = sync.Pool{New: func() any { return make(map[string]any) }}
+)
+
+// maxPooledBufferSize prevents unusually large buffers from being kept in the pool.
+const maxPooledBufferSize = 64 << 10
+
+func (h *Handler) generateMessageContent(r slog.Record) string {
+	content := bufferPool.Get().(*bytes.Buffer)
+	content.Reset()
+	defer func() {
+		if content.Cap() <= maxPooledBufferSize {
+			bufferPool.Put(content)
+		}
+	}()
+
+	if badge := h.badge(); badge != "" {
+		content.WriteString(badge)
+		content.WriteByte(' ')
+	}
+	// stampWidth is the number of runes of the header stamp beyond the one column it renders as
+	stampWidth := 0
+	if h.opt.MinimalHeader {
+		content.WriteString(h.levelName(r.Level))
+		content.WriteByte(' ')
+		if !r.Time.IsZero() {
+			content.WriteString(r.Time.Format(time.TimeOnly))
+			content.WriteByte(' ')
+		}
+	} else {
+		// level
+		if h.opt.StampPosition == StampPrefix {
+			stamp := h.levelStamp(r.Level)
+			stampWidth = utf8.RuneCountInString(stamp) - 1
+			content.WriteString(stamp)
+			content.WriteByte(' ')
+		}
+		if h.opt.ShowLevelText {
+			content.WriteString(h.levelName(r.Level))
+			content.WriteByte(' ')
+		}
+		// time
+		if !r.Time.IsZero() {
+			content.WriteString("[")
+			content.WriteString(r.Time.Format(time.DateTime))
+			content.WriteString("] ")
+		}
+	}
+	// message
+	msg := h.scrub(r.Message)
+	if h.opt.NormalizeNewlines {
+		msg = strings.ReplaceAll(msg, "\r\n", "\n")
+		msg = strings.ReplaceAll(msg, "\r", "\n")
+	}
+	if h.opt.NeutralizeChannelLinks {
+		msg = strings.ReplaceAll(msg, "#", `\#`)
+	}
+	if h.opt.WrapWidth > 0 {
+		// the header takes up the start of the first line
+		msg = wrapText(msg, h.opt.WrapWidth, utf8.RuneCount(content.Bytes())-stampWidth)
+	}
+	content.WriteString(msg)
+	if h.opt.LatencyFromKey != "" {
+		if d, ok := h.latency(r); ok {
+			content.WriteString(" (took ")
+			content.WriteString(d.String())
+			content.WriteString(")")
+		}
+	}
+	if h.opt.AddSource && r.PC != 0 {
+		content.WriteByte(' ')
+		content.WriteString(h.source(r.PC))
+	}
+	if !h.opt.MinimalHeader && h.opt.StampPosition == StampSuffix {
+		content.WriteByte(' ')
+		content.WriteString(h.levelStamp(r.Level))
+	}
+	for _, role := range h.opt.MentionRolesByLevel[r.Level] {
+		content.WriteString(" @")
+		content.WriteString(role)
+	}
+
+	// attributes
+	attrs := attrsPool.Get().(map[string]any)
+	defer func() {
+		clear(attrs)
+		attrsPool.Put(attrs)
+	}()
+	cur := h.extractMapInto(attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		h.appendAttr(cur, h.groups, a)
+		return true
+	})
+	if len(h.opt.KeyUnits) > 0 {
+		applyUnits(attrs, h.opt.KeyUnits)
+	}
+	if h.opt.LargeIntAsString {
+		quoteLargeInts(attrs)
+	}
+	pruneEmptyGroups(attrs)
+	if len(h.opt.FlattenGroupNames) > 0 {
+		flattenGroups(attrs, h.opt.FlattenGroupNames)
+	}
+	var snippets []snippet
+	if h.opt.DetectCodeLang {
+		snippets = extractSnippets(attrs)
+	}
+	var lists []list
+	if h.opt.ArraysAsBullets {
+		lists = extractLists(attrs)
+	}
+	if h.opt.MaxAttrsBytes > 0 {
+		dropLargestAttrs(attrs, h.opt.MaxAttrsBytes)
+	}
+	if len(attrs) > 0 {
+		if !h.opt.CompactMobile || !writeCompactAttrs(content, normalizeKeys(attrs, h.opt.InlineKeyNormalizer)) {
+			h.writeAttrBlock(content, normalizeKeys(attrs, h.opt.JSONKeyNormalizer))
+		}
+	}
+	for _, l := range lists {
+		fmt.Fprintf(content, "\n%s:", l.key)
+		for _, item := range l.items {
+			content.WriteString("\n- ")
+			content.WriteString(item)
+		}
+	}
+	for _, s := range snippets {
+		fmt.Fprintf(content, "\n%s:\n```%s\n%s\n```", s.key, s.lang, s.code)
+	}
+
+	// scrub the rendered content to cover values of any type, however they are rendered
+	return h.scrub(content.String())
+}
+
+// truncatedKey is the attribute added by dropLargestAttrs with the number of dropped attributes.
+const truncatedKey = "_truncated"
+
+// dropLargestAttrs removes the largest top-level attributes until attrs, including the
+// truncatedKey note it adds, encodes to at most budget bytes of JSON block where possible.
+// It leaves attrs that fail to encode as they are, for writeAttrBlock to report.
+func dropLargestAttrs(attrs map[string]any, budget int) {
+	dropped := 0
+	for len(attrs) > min(dropped, 1) {
+		var b bytes.Buffer
+		if err := encodeAttrs(&b, attrs); err != nil || b.Len() <= budget {
+			break
+		}
+		largest, largestSize := "", -1
+		for k, v := range attrs {
+			if dropped > 0 && k == truncatedKey {
+				continue
+			}
+			b, _ := json.Marshal(v)
+			if size := len(k) + len(b); size > largestSize || size == largestSize && k < largest {
+				largest, largestSize = k, size
+			}
+		}
+		delete(attrs, largest)
+		dropped++
+		attrs[truncatedKey] = dropped
+	}
+}
+
+// list is a slice attribute rendered as a bullet list.
+type list struct {
+	key   string
+	items []string
+}
+
+// extractLists removes slice values other than []byte from attrs and returns them sorted by key.
+func extractLists(attrs map[string]any) []list {
+	var lists []list
+	for _, k := range slices.Sorted(maps.Keys(attrs)) {
+		v := reflect.ValueOf(attrs[k])
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+			continue
+		}
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		lists = append(lists, list{key: k, items: items})
+		delete(attrs, k)
+	}
+	return lists
+}
+
+// snippet is a code-like attribute value rendered in its own code block.
+type snippet struct {
+	key  string
+	lang string
+	code string
+}
+
+// extractSnippets removes code-like string values from attrs and returns them sorted by key.
+func extractSnippets(attrs map[string]any) []snippet {
+	var snippets []snippet
+	for _, k := range slices.Sorted(maps.Keys(attrs)) {
+		v, ok := attrs[k].(string)
+		if !ok {
+			continue
+		}
+		if lang := detectCodeLang(v); lang != "" {
+			snippets = append(snippets, snippet{key: k, lang: lang, code: strings.TrimSpace(v)})
+			delete(attrs, k)
+		}
+	}
+	return snippets
+}
+
+var (
+	sqlKeywords = []string{"SELECT", "INSERT", "UPDATE", "DELETE", "WITH", "CREATE", "ALTER", "DROP"}
+	// sqlClauses are words that follow the keywords above in a statement,
+	// to tell queries from values like "update pending"
+	sqlClauses = []string{"FROM", "INTO", "SET", "TABLE"}
+)
+
+// detectCodeLang returns the code fence language of s, or "" if s does not look like code.
+func detectCodeLang(s string) string {
+	s = strings.TrimSpace(s)
+	if (strings.HasPrefix(s, "{") || strings.HasPrefix(s, "[")) && json.Valid([]byte(s)) {
+		return "json"
+	}
+	if strings.HasPrefix(s, "goroutine ") || strings.HasPrefix(s, "panic: ") && strings.Contains(s, "\ngoroutine ") {
+		return "text"
+	}
+	if words := strings.Fields(s); len(words) > 1 && slices.Contains(sqlKeywords, words[0]) &&
+		slices.ContainsFunc(words[1:], func(w string) bool { return slices.Contains(sqlClauses, w) }) {
+		return "sql"
+	}
+	return ""
+}
+
+func (h *Handler) writeAttrBlock(b *bytes.Buffer, attrs map[string]any) {
+	switch h.opt.AttrFormat {
+	case AttrFormatYAML:
+		b.WriteString(h.blockSeparator())
+		b.WriteString("```yaml\n")
+		writeYAML(b, attrs, 0)
+	default:
+		// the encoder writes nothing on failure, so the fence is written afterwards
+		var encoded bytes.Buffer
+		if err := encodeAttrs(&encoded, attrs); err != nil {
+			h.writeEncodeError(b, err, attrs)
+			return
+		}
+		b.WriteString(h.blockSeparator())
+		b.WriteString("```json\n")
+		b.Write(encoded.Bytes())
+	}
+	b.WriteString("```")
+}
+
+// encodeAttrs writes attrs to w as the indented JSON of an attribute block.
+func encodeAttrs(w io.Writer, attrs map[string]any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(attrs)
+}
+
+func (h *Handler) blockSeparator() string {
+	if h.opt.BlockSeparator == "" {
+		return "\n"
+	}
+	return h.opt.BlockSeparator
+}
+
+// writeEncodeError writes the replacement for an attribute block that failed to encode.
+func (h *Handler) writeEncodeError(b *bytes.Buffer, err error, attrs map[string]any) {
+	b.WriteString(h.blockSeparator())
+	if h.opt.OnEncodeError != nil {
+		// attrs is reused for the next record once this returns
+		b.WriteString(h.opt.OnEncodeError(err, deepCopyMap(attrs)))
+		return
+	}
+	fmt.Fprintf(b, "```text\n%v\n```", attrs)
+}
+
+// writeYAML writes m as a YAML block mapping sorted by key.
+// Scalar values are written as JSON, which is valid YAML flow syntax.
+func writeYAML(b *bytes.Buffer, m map[string]any, indent int) {
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		b.WriteString(strings.Repeat("  ", indent))
+		b.WriteString(yamlKey(k))
+		b.WriteByte(':')
+		if vm, ok := m[k].(map[string]any); ok && len(vm) > 0 {
+			b.WriteByte('\n')
+			writeYAML(b, vm, indent+1)
+			continue
+		}
+		b.WriteByte(' ')
+		v, err := json.Marshal(m[k])
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(m[k]))
+		}
+		b.Write(v)
+		b.WriteByte('\n')
+	}
+}
+
+func yamlKey(k string) string {
+	if k == "" || strings.ContainsFunc(k, func(r rune) bool {
+		return !(r == '_' || r == '-' || r == '.' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')
+	}) {
+		q, _ := json.Marshal(k)
+		return string(q)
+	}
+	return k
+}
+
+// normalizeKeys returns a copy of m with all keys, including those of groups, rewritten by f.
+// It returns m itself if f is nil.
+func normalizeKeys(m map[string]any, f func(string) string) map[string]any {
+	if f == nil {
+		return m
+	}
+	normalized := make(map[string]any, len(m))
+	for k, v := range m {
+		if vm, ok := v.(map[string]any); ok {
+			v = normalizeKeys(vm, f)
+		}
+		normalized[f(k)] = v
+	}
+	return normalized
+}
+
+// flattenGroups replaces the named groups in m, at any depth, with their
+// members under keys prefixed by the group name and a dot.
+func flattenGroups(m map[string]any, names []string) {
+	for _, v := range m {
+		if vm, ok := v.(map[string]any); ok {
+			flattenGroups(vm, names)
+		}
+	}
+	for _, name := range names {
+		group, ok := m[name].(map[string]any)
+		if !ok {
+			continue
+		}
+		delete(m, name)
+		for k, v := range group {
+			m[name+"."+k] = v
+		}
+	}
+}
+
+// pruneEmptyGroups removes groups left without attributes, such as a group opened
+// by WithGroup that no attribute was added to, so that no empty block is rendered.
+func pruneEmptyGroups(m map[string]any) {
+	for k, v := range m {
+		if vm, ok := v.(map[string]any); ok {
+			pruneEmptyGroups(vm)
+			if len(vm) == 0 {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+// maxSafeInteger is the largest integer a float64 (and thus a JavaScript number) represents exactly.
+const maxSafeInteger = 1<<53 - 1
+
+// quoteLargeInts replaces integers beyond ±maxSafeInteger in m and its groups with their decimal string.
+func quoteLargeInts(m map[string]any) {
+	for k, v := range m {
+		switch v := v.(type) {
+		case map[string]any:
+			quoteLargeInts(v)
+		case int:
+			if v > maxSafeInteger || v < -maxSafeInteger {
+				m[k] = strconv.Itoa(v)
+			}
+		case int64:
+			if v > maxSafeInteger || v < -maxSafeInteger {
+				m[k] = strconv.FormatInt(v, 10)
+			}
+		case uint:
+			if v > maxSafeInteger {
+				m[k] = strconv.FormatUint(uint64(v), 10)
+			}
+		case uint64:
+			if v > maxSafeInteger {
+				m[k] = strconv.FormatUint(v, 10)
+			}
+		}
+	}
+}
+
+// applyUnits appends the configured unit to the values of matching keys in m and its groups.
+func applyUnits(m map[string]any, units map[string]string) {
+	for k, v := range m {
+		if vm, ok := v.(map[string]any); ok {
+			applyUnits(vm, units)
+		} else if unit, ok := units[k]; ok {
+			m[k] = fmt.Sprintf("%v%s", v, unit)
+		}
+	}
+}
+
+// compactValueLimit is the maximum number of characters of a value rendered in compact mode.
+const compactValueLimit = 32
+
+// writeCompactAttrs writes attrs on a single line sorted by key.
+// It reports false without writing anything if attrs contains a nested group.
+func writeCompactAttrs(b *bytes.Buffer, attrs map[string]any) bool {
+	for _, v := range attrs {
+		if _, ok := v.(map[string]any); ok {
+			return false
+		}
+	}
+
+	b.WriteByte('\n')
+	for i, k := range slices.Sorted(maps.Keys(attrs)) {
+		if i > 0 {
+			b.WriteString(" · ")
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(truncate(fmt.Sprint(attrs[k]), compactValueLimit))
+	}
+	return true
+}
+
+func truncate(s string, limit int) string {
+	r := []rune(s)
+	if len(r) <= limit {
+		return s
+	}
+	return string(r[:limit]) + "…"
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.withAttrs(attrs)
+}
+
+// With returns a Handler that includes the given attributes in each output.
+// The arguments are interpreted the same way as [slog.Logger.With]:
+// alternating key/value pairs, where a dangling or non-string key is stored under "!BADKEY".
+func (h *Handler) With(args ...any) *Handler {
+	return h.withAttrs(argsToAttrs(args))
+}
+
+func (h *Handler) withAttrs(attrs []slog.Attr) *Handler {
+	h2 := h.clone()
+	for _, attr := range attrs {
+		if channel, ok := channelOf(attr); ok {
+			h2.channel = channel
+			continue
+		}
+		h2.appendAttr(h2.cur, h2.groups, attr)
+	}
+	if h2.fallback != nil {
+		h2.fallback = h2.fallback.WithAttrs(attrs)
+	}
+	return h2
+}
+
+const badKey = "!BADKEY"
+
+func argsToAttrs(args []any) []slog.Attr {
+	var attrs []slog.Attr
+	for len(args) > 0 {
+		switch x := args[0].(type) {
+		case string:
+			if len(args) == 1 {
+				attrs = append(attrs, slog.String(badKey, x))
+				args = nil
+			} else {
+				attrs = append(attrs, slog.Any(x, args[1]))
+				args = args[2:]
+			}
+		case slog.Attr:
+			attrs = append(attrs, x)
+			args = args[1:]
+		default:
+			attrs = append(attrs, slog.Any(badKey, x))
+			args = args[1:]
+		}
+	}
+	return attrs
+}
+
+// appendAttr adds attr, enclosed in groups, to m.
+func (h *Handler) appendAttr(m map[string]any, groups []string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if h.opt.ReplaceAttr != nil && attr.Value.Kind() != slog.KindGroup {
+		attr = h.opt.ReplaceAttr(groups, attr)
+		if attr.Equal(slog.Attr{}) {
+			return
+		}
+		attr.Value = attr.Value.Resolve()
+	}
+	if h.redacted(attr.Key) {
+		m[attr.Key] = redacted
+		return
+	}
+	if attr.Value.Kind() != slog.KindGroup {
+		v := attr.Value.Any()
+		if err, ok := v.(error); ok {
+			m[attr.Key] = err.Error()
+			if h.opt.IncludeErrorType {
+				m[attr.Key+"_type"] = fmt.Sprintf("%T", err)
+			}
+			return
+		}
+		if b, ok := v.([]byte); ok {
+			m[attr.Key] = h.renderBytes(b)
+			return
+		}
+		m[attr.Key] = v
+		return
+	}
+
+	if len(attr.Value.Group()) == 0 {
+		return
+	}
+
+	if attr.Key == "" {
+		// inline group
+		maps.Copy(m, h.convertGroupToMap(groups, attr.Value))
+	} else {
+		if h.opt.ReplaceAttr != nil {
+			groups = append(slices.Clip(groups), attr.Key)
+		}
+		m[attr.Key] = h.convertGroupToMap(groups, attr.Value)
+	}
+}
+
+// redacted reports whether the value of the attribute with key is hidden by
+// Option.RedactKeys or Option.RedactKeyPatterns.
+func (h *Handler) redacted(key string) bool {
+	for _, k := range h.opt.RedactKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	for _, p := range h.opt.RedactKeyPatterns {
+		if p.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// renderBytes returns the value of b as rendered by Option.BytesRender.
+func (h *Handler) renderBytes(b []byte) any {
+	switch h.opt.BytesRender {
+	case BytesRenderHex:
+		return hex.EncodeToString(b)
+	case BytesRenderTruncated:
+		if len(b) <= truncatedBytesLength {
+			return fmt.Sprintf("%x (%d bytes)", b, len(b))
+		}
+		return fmt.Sprintf("%x… (%d bytes)", b[:truncatedBytesLength], len(b))
+	default:
+		return b
+	}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	h2 := h.clone()
+	h2.groups = append(h2.groups, name)
+	newMap := make(map[string]any)
+	h2.cur[name] = newMap
+	h2.cur = newMap
+	if h2.fallback != nil {
+		h2.fallback = h2.fallback.WithGroup(name)
+	}
+	return h2
+}
+
+func (h *Handler) clone() *Handler {
+	attrs, cur := h.extractMap()
+	return &Handler{
+		client: h.client,
+		opt:    h.opt,
+		ch:     h.ch,
+		stats:  h.stats,
+		ctrl:   h.ctrl,
+		done:   h.done,
+
+		disabled: h.disabled,
+
+		shutdown: h.shutdown,
+		stamps:   h.stamps,
+		dedup:    h.dedup,
+
+		groups:   slices.Clip(h.groups),
+		attrs:    attrs,
+		cur:      cur,
+		fallback: h.fallback,
+		channel:  h.channel,
+	}
+}
+
+func (h *Handler) extractMap() (map[string]any, map[string]any) {
+	newAttrs := make(map[string]any, len(h.attrs))
+	return newAttrs, h.extractMapInto(newAttrs)
+}
+
+// extractMapInto deep copies the handler's attributes into the empty map dst
+// and returns the map of the innermost group.
+func (h *Handler) extractMapInto(dst map[string]any) map[string]any {
+	copyMapInto(dst, h.attrs)
+	newCur := dst
+	for _, name := range h.groups {
+		if m, ok := newCur[name].(map[string]any); ok {
+			newCur = m
+		} else {
+			break
+		}
+	}
+	return newCur
+}
+
+func (h *Handler) convertGroupToMap(groups []string, v slog.Value) map[string]any {
+	attrs := v.Group()
+	if len(attrs) == 0 {
+		return nil
+	}
+	m := make(map[string]any, len(attrs))
+	for _, a := range attrs {
+		h.appendAttr(m, groups, a)
+	}
+	return m
+}
+
+// wrapText breaks the lines of s at spaces so that they fit in width columns where possible.
+// The first line starts at column offset. Words longer than width are not broken.
+func wrapText(s string, width, offset int) string {
+	var b strings.Builder
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			b.WriteByte('\n')
+			offset = 0
+		}
+		col := offset
+		for j, word := range strings.Split(line, " ") {
+			n := utf8.RuneCountInString(word)
+			switch {
+			case j == 0:
+			case col+1+n > width:
+				b.WriteByte('\n')
+				col = 0
+			default:
+				b.WriteByte(' ')
+				col++
+			}
+			b.WriteString(word)
+			col += n
+		}
+	}
+	return b.String()
+}
+
+// latency returns the time elapsed between the Option.LatencyFromKey attribute of r and r itself.
+func (h *Handler) latency(r slog.Record) (time.Duration, bool) {
+	var start time.Time
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key != h.opt.LatencyFromKey {
+			return true
+		}
+		if v := a.Value.Resolve(); v.Kind() == slog.KindTime {
+			start = v.Time()
+		}
+		return false
+	})
+	if start.IsZero() {
+		return 0, false
+	}
+	end := r.Time
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(start).Round(time.Millisecond), true
+}
+
+// badge returns the inline code badge of Option.Environment and Option.Name, if any.
+func (h *Handler) badge() string {
+	var label string
+	switch {
+	case h.opt.Environment != "" && h.opt.Name != "":
+		label = h.opt.Environment + "/" + h.opt.Name
+	case h.opt.Environment != "":
+		label = h.opt.Environment
+	case h.opt.Name != "":
+		label = h.opt.Name
+	default:
+		return ""
+	}
+	return "`" + label + "`"
+}
+
+func (h *Handler) levelName(level slog.Level) string {
+	if name, ok := h.opt.LevelNames[level]; ok {
+		return name
+	}
+	return level.String()
+}
+
+// LoadStamps replaces the level stamps of the handler and all handlers derived from it
+// with a mapping read from r, one "LEVEL=stamp" per line such as "ERROR=:fire:".
+// Blank lines and lines starting with "#" are ignored, and levels missing from the
+// mapping keep their default stamp. The stamps are unchanged if r is malformed.
+func (h *Handler) LoadStamps(r io.Reader) error {
+	stamps := make(map[slog.Level]string)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, stamp, ok := strings.Cut(line, "=")
+		var level slog.Level
+		if !ok || level.UnmarshalText([]byte(strings.TrimSpace(name))) != nil {
+			return fmt.Errorf("slogtraq: invalid stamp mapping on line %d: %q", n, line)
+		}
+		stamps[level] = strings.TrimSpace(stamp)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	h.stamps.Store(&stamps)
+	return nil
+}
+
+// levelStamp returns the stamp of level, preferring those loaded by LoadStamps.
+func (h *Handler) levelStamp(level slog.Level) string {
+	if stamps := h.stamps.Load(); stamps != nil {
+		if stamp, ok := (*stamps)[level]; ok {
+			return stamp
+		}
+	}
+	if stamp := writeLevelStamp(level); stamp != "" {
+		return stamp
+	}
+	if h.opt.DefaultStamp != "" {
+		return h.opt.DefaultStamp
+	}
+	return ":question:"
+}
+
+// writeLevelStamp returns the stamp of the standard levels, or "" for others.
+func writeLevelStamp(level slog.Level) string {
+	switch level {
+	case slog.LevelDebug:
+		return ":gear:"
+	case slog.LevelInfo:
+		return ":information_source:"
+	case slog.LevelWarn:
+		return ":warning:"
+	case slog.LevelError:
+		return ":alert:"
+	default:
+		return ""
+	}
+}
+
+func (h *Handler) sendMessageLoop() {
+	defer close(h.done)
+	var buf sendBuffer
+	// the ticker is a timer so that each period can be jittered,
+	// rescheduled relative to the previous tick to keep a steady cadence
+	nextFlush := time.Now().Add(h.flushDelay())
+	ticker := time.NewTimer(time.Until(nextFlush))
+	first := h.opt.FirstFlushImmediate
+	// recent holds the records preceding errors per channel for Option.ErrorContextLines
+	recent := make(map[string]*ring)
+	age := time.NewTimer(0)
+	age.Stop()
+	// lastAged is when MaxRecordAge last forced a flush, so that records
+	// re-buffered by it wait for another period instead of spinning
+	var lastAged time.Time
+	var digest errorDigest
+	// the heartbeat is due relative to the later of the last batch and the last heartbeat
+	var lastHeartbeat time.Time
+	var heartbeatStats Stats
+	if h.opt.Heartbeat > 0 {
+		lastHeartbeat = time.Now()
+		heartbeatStats = h.Stats()
+	}
+
+	// record counts per level since the last daily summary
+	counts := make(map[slog.Level]int)
+	since := time.Now()
+	var summary <-chan time.Time
+	if h.opt.DailySummary {
+		summary = time.After(time.Until(nextDailyTime(since, h.opt.DailySummaryHour)))
+	}
+
+	for {
+		if h.opt.MaxRecordAge > 0 {
+			if len(buf.msgs) > 0 {
+				oldest := buf.msgs[0].queued
+				if oldest.Before(lastAged) {
+					oldest = lastAged
+				}
+				age.Reset(time.Until(oldest.Add(h.opt.MaxRecordAge)))
+			} else {
+				age.Stop()
+			}
+		}
+
+		select {
+		case msg, ok := <-h.ch:
+			if !ok {
+				h.closing = true
+				h.shutdown.err = h.flushBufferContext(h.shutdown.ctx, &buf, 0)
+				if len(digest.messages) > 0 {
+					h.flush(context.Background(), h.channelID(), []message{{
+						level:   slog.LevelError,
+						content: digest.content(),
+					}})
+				}
+				return
+			}
+			if msg.flush != nil {
+				msg.flush.result <- h.flushBufferContext(msg.flush.ctx, &buf, 0)
+				continue
+			}
+			counts[msg.level]++
+			if h.opt.ErrorDigestOnClose && msg.level >= slog.LevelError {
+				digest.add(msg.text)
+			}
+			if msg.jsonLine != nil {
+				_, err := h.opt.JSONMirrorWriter.Write(msg.jsonLine)
+				h.reportError(err)
+				msg.jsonLine = nil
+			}
+			if msg.divert {
+				h.writeFallback(msg.content)
+				continue
+			}
+			if h.opt.ErrorContextLines > 0 {
+				r := recent[msg.channel]
+				if r == nil {
+					r = newRing(h.opt.ErrorContextLines)
+					recent[msg.channel] = r
+				}
+				content := msg.content
+				if msg.level >= slog.LevelError {
+					msg.content = withContext(r.items(), msg.content)
+				}
+				r.push(content)
+			}
+			h.stats.drops.add(buf.add(msg, h.opt.MaxBufferedBytes), time.Now())
+			if h.opt.ErrorMirrorChannelID != "" && msg.level >= slog.LevelError {
+				h.mirrorError(msg)
+			}
+			if first || msg.priority > 0 || h.delivery(msg.level) == DeliveryImmediate ||
+				h.opt.FlushAfterErrors > 0 && buf.errors >= h.opt.FlushAfterErrors ||
+				h.opt.MaxBatchCount > 0 && len(buf.msgs) >= h.opt.MaxBatchCount {
+				h.flushBuffer(&buf, 0)
+				first = false
+			}
+		case <-ticker.C:
+			if h.opt.Heartbeat > 0 && len(buf.msgs) == 0 && !h.stats.drops.hasPending() {
+				if now := time.Now(); now.Sub(lastHeartbeat) >= h.opt.Heartbeat && now.Sub(h.lastFlush) >= h.opt.Heartbeat {
+					h.flush(context.Background(), h.channelID(), []message{{
+						level:   slog.LevelInfo,
+						content: h.heartbeatContent(h.Stats().since(heartbeatStats)),
+					}})
+					lastHeartbeat = now
+					heartbeatStats = h.Stats()
+				}
+			}
+			h.flushBuffer(&buf, h.opt.TailBuffer)
+			nextFlush = nextFlush.Add(h.flushDelay())
+			if now := time.Now(); nextFlush.Before(now) {
+				// skip missed ticks like time.Ticker does
+				nextFlush = now.Add(h.flushDelay())
+			}
+			ticker.Reset(time.Until(nextFlush))
+		case lastAged = <-age.C:
+			h.flushBuffer(&buf, 0)
+		case f := <-h.ctrl:
+			f(&buf)
+		case now := <-summary:
+			h.flushBuffer(&buf, 0)
+			h.flush(context.Background(), h.channelID(), []message{{
+				level:   slog.LevelInfo,
+				content: h.summaryContent(counts, since),
+			}})
+			clear(counts)
+			since = now
+			summary = time.After(time.Until(nextDailyTime(now, h.opt.DailySummaryHour)))
+		}
+	}
+}
+
+// channelID returns the channel records are posted to, taking Option.ReviewMode into account.
+func (h *Handler) channelID() string {
+	if h.opt.ReviewMode {
+		return h.opt.ReviewChannelID
+	}
+	return h.opt.ChannelID
+}
+
+// mirrorError posts msg to Option.ErrorMirrorChannelID right away. The mirror is a copy
+// of a record that is posted anyway, so a failed post is reported but neither retried
+// nor counted as a failure, which would hold back the main channel.
+func (h *Handler) mirrorError(msg message) {
+	msg.channel = h.opt.ErrorMirrorChannelID
+	msg.fingerprint = ""
+	// the record is delivered to the fallback only if the original post fails
+	msg.original = nil
+	ctx := h.sendContext(context.Background(), msg.level)
+	var err error
+	if msg.pin {
+		err = h.sendAlone(ctx, msg.channel, msg)
+	} else {
+		_, err = h.sendBatch(ctx, msg.channel, []message{msg})
+	}
+	if err != nil {
+		h.reportError(err)
+		h.undelivered(ctx, []message{msg}, err)
+	}
+}
+
+// writeFallback writes content to Option.FallbackWriter, if any.
+func (h *Handler) writeFallback(content string) {
+	if h.opt.FallbackWriter == nil {
+		return
+	}
+	_, err := io.WriteString(h.opt.FallbackWriter, content+"\n")
+	h.reportError(err)
+}
+
+// flushDelay returns the time until the next periodic flush.
+func (h *Handler) flushDelay() time.Duration {
+	d := h.opt.FlushInterval
+	if d <= 0 {
+		d = time.Second
+	}
+	return d + h.jitter(h.opt.FlushJitter)
+}
+
+// jitter returns a random duration in [0, d) from Option.Rand, or zero if d is not positive.
+func (h *Handler) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	if h.opt.Rand != nil {
+		return time.Duration(h.opt.Rand.Int64N(int64(d)))
+	}
+	return rand.N(d)
+}
+
+func (h *Handler) heartbeatContent(stats Stats) string {
+	if h.opt.HeartbeatContent != nil {
+		return h.opt.HeartbeatContent(stats)
+	}
+	return ":heartbeat: alive"
+}
+
+// nextDailyTime returns the first time after now at the given hour.
+func nextDailyTime(now time.Time, hour int) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// errorDigest counts distinct error messages in the order they were first seen.
+type errorDigest struct {
+	messages []string
+	counts   map[string]int
+}
+
+func (d *errorDigest) add(text string) {
+	if d.counts == nil {
+		d.counts = make(map[string]int)
+	}
+	if d.counts[text] == 0 {
+		d.messages = append(d.messages, text)
+	}
+	d.counts[text]++
+}
+
+func (d *errorDigest) content() string {
+	var b strings.Builder
+	b.WriteString(":clipboard: Error digest")
+	for _, text := range d.messages {
+		fmt.Fprintf(&b, "\n%d× %s", d.counts[text], text)
+	}
+	return b.String()
+}
+
+func (h *Handler) summaryContent(counts map[slog.Level]int, since time.Time) string {
+	var b strings.Builder
+	b.WriteString(":bar_chart: Log summary since ")
+	b.WriteString(since.Format(time.DateTime))
+	if len(counts) == 0 {
+		b.WriteString("\nno logs")
+	}
+	for _, level := range slices.Sorted(maps.Keys(counts)) {
+		fmt.Fprintf(&b, "\n%s: %d", h.levelName(level), counts[level])
+	}
+	return b.String()
+}
+
+// shortDuration formats d truncated to seconds without zero units, e.g. "5m" instead of "5m0s".
+func shortDuration(d time.Duration) string {
+	s := d.Truncate(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// sendBuffer holds messages waiting for the next flush in arrival order.
+type sendBuffer struct {
+	msgs []message
+	// size is the total length of buffered content in bytes.
+	size int
+	// errors is the number of buffered Error-level messages.
+	errors int
+}
+
+// add appends msg and evicts the oldest messages while the buffer exceeds limit.
+// It returns the number of evicted messages.
+func (b *sendBuffer) add(msg message, limit int) (evicted int) {
+	if msg.queued.IsZero() {
+		msg.queued = time.Now()
+	}
+	b.msgs = append(b.msgs, msg)
+	b.size += len(msg.content)
+	if msg.level >= slog.LevelError {
+		b.errors++
+	}
+	for limit > 0 && b.size > limit && len(b.msgs) > 0 {
+		if b.msgs[0].level >= slog.LevelError {
+			b.errors--
+		}
+		b.size -= len(b.msgs[0].content)
+		b.msgs = b.msgs[1:]
+		evicted++
+	}
+	return evicted
+}
+
+// requeue puts msgs back in front of the buffered messages.
+func (b *sendBuffer) requeue(msgs []message) {
+	b.msgs = append(slices.Clip(msgs), b.msgs...)
+	for _, msg := range msgs {
+		b.size += len(msg.content)
+		if msg.level >= slog.LevelError {
+			b.errors++
+		}
+	}
+}
+
+// take removes and returns all but the newest keep messages.
+func (b *sendBuffer) take(keep int) []message {
+	n := max(len(b.msgs)-keep, 0)
+	taken := b.msgs[:n:n]
+	b.msgs = b.msgs[n:]
+	for _, msg := range taken {
+		b.size -= len(msg.content)
+		if msg.level >= slog.LevelError {
+			b.errors--
+		}
+	}
+	return taken
+}
+
+// ring holds the newest strings pushed to it, up to a fixed capacity.
+type ring struct {
+	buf  []string
+	next int
+	full bool
+}
+
+func newRing(size int) *ring {
+	return &ring{buf: make([]string, max(size, 0))}
+}
+
+func (r *ring) push(s string) {
+	if len(r.buf) == 0 {
+		return
+	}
+	r.buf[r.next] = s
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// items returns the held strings from oldest to newest.
+func (r *ring) items() []string {
+	if !r.full {
+		return r.buf[:r.next]
+	}
+	return append(slices.Clone(r.buf[r.next:]), r.buf[:r.next]...)
+}
+
+// withContext prepends the preceding records to content.
+func withContext(preceding []string, content string) string {
+	if len(preceding) == 0 {
+		return content
+	}
+	var b strings.Builder
+	b.WriteString("```text\n")
+	for _, p := range preceding {
+		b.WriteString(p)
+		b.WriteString("\n")
+	}
+	b.WriteString("```\n")
+	b.WriteString(content)
+	return b.String()
+}
+
+// flushBuffer sends all buffered messages except the newest keep.
+func (h *Handler) flushBuffer(buf *sendBuffer, keep int) {
+	if time.Now().Before(h.retryAt) || h.throttled() {
+		// back off after a failed send
+		return
+	}
+	h.flushBufferContext(context.Background(), buf, keep)
+}
+
+// flushBufferContext is flushBuffer bounded by ctx. It returns the errors of failed sends,
+// or the error of ctx if the flush was aborted and the remaining records re-buffered.
+// The final flush on close gives up the records it leaves unsent instead, as nothing
+// would send them later.
+func (h *Handler) flushBufferContext(ctx context.Context, buf *sendBuffer, keep int) error {
+	msgs := buf.take(keep)
+	if n, first, last := h.stats.drops.take(); n > 0 {
+		when := "at " + first.Format(time.TimeOnly)
+		if from, to := first.Format(time.TimeOnly), last.Format(time.TimeOnly); from != to {
+			when = fmt.Sprintf("between %s and %s", from, to)
+		}
+		notice := message{
+			level:   slog.LevelWarn,
+			content: fmt.Sprintf(":warning: %d log records were dropped %s", n, when),
+			channel: h.channelID(),
+		}
+		msgs = append([]message{notice}, msgs...)
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	if gap := now.Sub(h.lastFlush); h.opt.ShowGaps > 0 && !h.lastFlush.IsZero() && gap > h.opt.ShowGaps {
+		notice := message{
+			level:   slog.LevelInfo,
+			content: fmt.Sprintf("⏱ %s since last log", shortDuration(gap)),
+			channel: h.channelID(),
+		}
+		msgs = append([]message{notice}, msgs...)
+	}
+	h.lastFlush = now
+
+	if h.degraded() && (now.Sub(h.lastProbe) < degradedProbeInterval || !h.probe()) {
+		err := fmt.Errorf("slogtraq: traQ is unreachable, %d records were not posted", len(msgs))
+		h.divert(ctx, msgs, err)
+		return err
+	}
+
+	if h.opt.FlushDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.opt.FlushDeadline)
+		defer cancel()
+	}
+
+	// group by destination channel, preserving arrival order within each channel
+	byChannel := make(map[string][]message)
+	for _, msg := range msgs {
+		byChannel[msg.channel] = append(byChannel[msg.channel], msg)
+	}
+	var unsent []message
+	var errs []error
+	for _, channel := range slices.Sorted(maps.Keys(byChannel)) {
+		u, err := h.flush(ctx, channel, byChannel[channel])
+		unsent = append(unsent, u...)
+		errs = append(errs, err)
+	}
+	if len(unsent) > 0 && h.closing {
+		err := fmt.Errorf("slogtraq: sending is paused, %d records were not posted before close", len(unsent))
+		if ctx.Err() != nil {
+			err = fmt.Errorf("slogtraq: flush aborted, %d records were not posted before close: %w", len(unsent), ctx.Err())
+		}
+		h.reportError(err)
+		h.giveUp(context.WithoutCancel(ctx), unsent, err)
+		return errors.Join(append(errs, err)...)
+	}
+	if len(unsent) > 0 {
+		buf.requeue(unsent)
+		if ctx.Err() != nil {
+			err := fmt.Errorf("slogtraq: flush aborted, %d records re-buffered: %w", len(unsent), ctx.Err())
+			h.reportError(err)
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flush sends msgs to channel and returns the messages left unsent
+// because ctx expired or the channel is over its rate limit.
+func (h *Handler) flush(ctx context.Context, channel string, msgs []message) ([]message, error) {
+	var unsent []message
+	var errs []error
+	batch := make([]message, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.fingerprint == "" && !msg.pin {
+			batch = append(batch, msg)
+			continue
+		}
+		if ctx.Err() != nil || h.throttled() {
+			unsent = append(unsent, msg)
+			continue
+		}
+		if err := h.sendAlone(h.sendContext(ctx, msg.level), channel, msg); err != nil {
+			if ctx.Err() != nil {
+				unsent = append(unsent, msg)
+			} else {
+				h.reportError(err)
+				errs = append(errs, err)
+				if h.throttle(err) {
+					unsent = append(unsent, msg)
+				} else if retry := h.retry([]message{msg}); retry != nil {
+					unsent = append(unsent, retry...)
+				} else {
+					h.giveUp(ctx, []message{msg}, err)
+				}
+			}
+		} else {
+			h.failures = 0
+		}
+	}
+	for _, group := range h.groupByToken(batch) {
+		if ctx.Err() != nil || h.throttled() || !h.limiter.allow(channel, time.Now()) {
+			unsent = append(unsent, group...)
+			continue
+		}
+		if left, err := h.sendBatch(h.sendContext(ctx, group[0].level), channel, group); err != nil {
+			if ctx.Err() != nil {
+				unsent = append(unsent, left...)
+			} else {
+				h.reportError(err)
+				errs = append(errs, err)
+				if h.throttle(err) {
+					unsent = append(unsent, left...)
+				} else if retry := h.retry(left); retry != nil {
+					unsent = append(unsent, retry...)
+				} else {
+					h.giveUp(ctx, left, err)
+				}
+			}
+		} else {
+			h.failures = 0
+		}
+	}
+	return unsent, errors.Join(errs...)
+}
+
+// throttle pauses sending if err is a *RateLimitError and reports whether it is.
+func (h *Handler) throttle(err error) bool {
+	var limited *RateLimitError
+	if !errors.As(err, &limited) {
+		return false
+	}
+	h.stats.throttled.Add(1)
+	if until := time.Now().Add(limited.RetryAfter).UnixNano(); until > h.stats.throttledUntil.Load() {
+		h.stats.throttledUntil.Store(until)
+	}
+	return true
+}
+
+// throttled reports whether sending is paused by traQ's rate limit.
+func (h *Handler) throttled() bool {
+	return time.Now().UnixNano() < h.stats.throttledUntil.Load()
+}
+
+// maxRetryBackoff caps the delay between retries.
+const maxRetryBackoff = 5 * time.Minute
+
+// retry returns msgs with the failed send counted, to be re-buffered, and backs off flushes.
+// It returns nil once Option.MaxRetries is exhausted.
+func (h *Handler) retry(msgs []message) []message {
+	attempts := 0
+	for _, msg := range msgs {
+		attempts = max(attempts, msg.attempts)
+	}
+	if h.closing || attempts >= h.opt.MaxRetries {
+		return nil
+	}
+	h.noteFailure()
+	attempts++
+	retry := slices.Clone(msgs)
+	for i := range retry {
+		retry[i].attempts = attempts
+	}
+
+	d := h.opt.RetryBackoff
+	if d <= 0 {
+		d = time.Second
+	}
+	d = min(d<<(attempts-1), maxRetryBackoff)
+	d += h.jitter(d / 2)
+	if at := time.Now().Add(d); at.After(h.retryAt) {
+		h.retryAt = at
+	}
+	return retry
+}
+
+// degradedProbeInterval is how often traQ is probed in degraded mode.
+const degradedProbeInterval = 30 * time.Second
+
+// degraded reports whether records are written to the fallback writer
+// because of Option.DegradeAfterFailures.
+func (h *Handler) degraded() bool {
+	return h.opt.DegradeAfterFailures > 0 && h.failures >= h.opt.DegradeAfterFailures
+}
+
+// giveUp handles msgs, whose send failed with err and is not retried, like undelivered,
+// diverting them in degraded mode.
+func (h *Handler) giveUp(ctx context.Context, msgs []message, err error) {
+	if h.noteFailure() {
+		h.divert(ctx, msgs, err)
+		return
+	}
+	h.undelivered(ctx, msgs, err)
+}
+
+// undelivered reports msgs, which were not posted because of err, to Option.OnError
+// and hands their records to Option.Fallback.
+func (h *Handler) undelivered(ctx context.Context, msgs []message, err error) {
+	if h.opt.OnError != nil {
+		h.opt.OnError(ctx, err, h.buildBatch(msgs))
+	}
+	for _, msg := range msgs {
+		h.handToFallback(ctx, msg)
+	}
+}
+
+// handToFallback passes the record of msg to Option.Fallback, if any.
+func (h *Handler) handToFallback(ctx context.Context, msg message) {
+	if o := msg.original; o != nil && o.h.Enabled(ctx, o.r.Level) {
+		h.reportError(o.h.Handle(ctx, o.r))
+	}
+}
+
+// noteFailure counts a failed send and reports whether it switched to or stays in degraded mode.
+func (h *Handler) noteFailure() bool {
+	h.failures++
+	if h.opt.DegradeAfterFailures > 0 && h.failures == h.opt.DegradeAfterFailures {
+		h.lastProbe = time.Now()
+		h.reportError(fmt.Errorf("slogtraq: %d consecutive send failures, writing to the fallback writer", h.failures))
+	}
+	return h.degraded()
+}
+
+// divert writes msgs, which were not posted because of err, to the fallback writer in degraded mode
+// and reports them like undelivered.
+func (h *Handler) divert(ctx context.Context, msgs []message, err error) {
+	for _, msg := range msgs {
+		h.writeFallback(msg.content)
+	}
+	h.diverted += len(msgs)
+	h.undelivered(ctx, msgs, err)
+}
+
+// probe posts a notice about the outage in degraded mode and reports whether it succeeded,
+// which ends degraded mode.
+func (h *Handler) probe() bool {
+	h.lastProbe = time.Now()
+	notice := fmt.Sprintf(":white_check_mark: traQ is reachable again, %d log records were written to the fallback writer meanwhile", h.diverted)
+	if _, err := h.post(context.Background(), h.channelID(), notice); err != nil {
+		h.reportError(err)
+		return false
+	}
+	h.failures = 0
+	h.diverted = 0
+	return true
+}
+
+// sendBatch posts batch in as few messages as fit, and on failure returns the messages that
+// were not posted yet, so that a retry does not post the earlier ones again.
+func (h *Handler) sendBatch(ctx context.Context, channel string, batch []message) ([]message, error) {
+	if err := h.waitTurn(ctx); err != nil {
+		return batch, err
+	}
+	if err := h.uploadAttachments(ctx, channel, batch); err != nil {
+		return batch, err
+	}
+	chunks := [][]message{batch}
+	if !h.opt.SingleMessagePerFlush {
+		chunks = h.packBatch(batch)
+	}
+	for i, chunk := range chunks {
+		content := h.buildBatch(chunk)
+		id, rest, err := h.sendContent(ctx, channel, len(chunk), content)
+		if err != nil {
+			unsent := slices.Concat(chunks[i+1:]...)
+			if rest != content {
+				return append([]message{remainder(chunk, rest)}, unsent...), err
+			}
+			return append(slices.Clone(chunk), unsent...), err
+		}
+		if stamp, ok := h.opt.ReactByLevel[highestLevel(chunk)]; ok {
+			if s, ok := h.client.(stamper); ok {
+				// the chunk is already posted, so a failed stamp must not fail the send and re-post it
+				h.reportError(s.addStamp(ctx, id, stamp))
+			}
+		}
+	}
+	return nil, nil
+}
+
+// remainder returns a message carrying rest, the part of the content of chunk that was
+// split across several messages and not posted yet.
+func remainder(chunk []message, rest string) message {
+	m := chunk[0]
+	if len(chunk) > 1 {
+		m = message{level: highestLevel(chunk), channel: m.channel, queued: m.queued, attempts: m.attempts}
+	}
+	m.content = rest
+	m.attachment = nil
+	return m
+}
+
+// packBatch splits batch between records into chunks that each fit in a message,
+// except for records too long by themselves, which get a chunk of their own.
+func (h *Handler) packBatch(batch []message) [][]message {
+	if h.fits(h.buildBatch(batch)) {
+		return [][]message{batch}
+	}
+	var chunks [][]message
+	start := 0
+	for end := 1; end < len(batch); end++ {
+		if !h.fits(h.buildBatch(batch[start : end+1])) {
+			chunks = append(chunks, batch[start:end])
+			start = end
+		}
+	}
+	return append(chunks, batch[start:])
+}
+
+// delivery returns the delivery mode of records at level.
+func (h *Handler) delivery(level slog.Level) DeliveryMode {
+	if mode, ok := h.opt.LevelDelivery[level]; ok {
+		return mode
+	}
+	if h.opt.ImmediateLevel != nil && level >= h.opt.ImmediateLevel.Level() {
+		return DeliveryImmediate
+	}
+	return DeliveryBatched
+}
+
+// fits reports whether content can be posted as a single message.
+func (h *Handler) fits(content string) bool {
+	if h.opt.MaxMessageBytes > 0 && len(content) > h.opt.MaxMessageBytes {
+		return false
+	}
+	return utf8.RuneCountInString(content) <= maxMessageLength
+}
+
+// sendContent posts the content of a batch of count records, as a file or split
+// if it is too long for a message, and returns the ID of its first message.
+// On failure, rest is the part of content that was not posted, which is all of it
+// unless content was split and some chunks were posted.
+func (h *Handler) sendContent(ctx context.Context, channel string, count int, content string) (id, rest string, err error) {
+	if h.opt.SingleMessagePerFlush && utf8.RuneCountInString(content) > maxMessageLength {
+		if u, ok := h.client.(fileUploader); ok {
+			id, err = h.sendAsFile(ctx, u, channel, count, content)
+			return id, content, err
+		}
+	}
+	if h.fits(content) {
+		id, err = h.post(ctx, channel, content)
+		return id, content, err
+	}
+	var chunks []string
+	if h.opt.SplitFunc != nil {
+		limit := maxMessageLength
+		if h.opt.MaxMessageBytes > 0 {
+			limit = min(limit, h.opt.MaxMessageBytes)
+		}
+		chunks = h.opt.SplitFunc(content, limit)
+	} else {
+		chunks = splitContentFunc(content, h.fits)
+	}
+	var first string
+	for i, chunk := range chunks {
+		id, err := h.post(ctx, channel, chunk)
+		if err != nil {
+			if i == 0 {
+				return "", content, err
+			}
+			return "", strings.Join(chunks[i:], "\n"), err
+		}
+		if i == 0 {
+			first = id
+		}
+	}
+	return first, "", nil
+}
+
+func highestLevel(msgs []message) slog.Level {
+	level := msgs[0].level
+	for _, msg := range msgs[1:] {
+		level = max(level, msg.level)
+	}
+	return level
+}
+
+// splitContentFunc splits content into chunks for which fits reports true, breaking at
+// newlines where possible. A code block open at the end of a chunk is closed there and
+// reopened at the start of the next one, so that each chunk renders on its own.
+func splitContentFunc(content string, fits func(chunk string) bool) []string {
+	join := func(lines []string, fence string) string {
+		s := strings.Join(lines, "\n")
+		if fence != "" {
+			s += "\n```"
+		}
+		return s
+	}
+
+	var chunks []string
+	lines := strings.Split(content, "\n")
+	var chunk []string
+	fence := "" // the opening line of the code block open at the end of chunk
+	// carried is the number of lines in chunk carried over from the previous one
+	carried := 0
+	for len(lines) > 0 {
+		line := lines[0]
+		next := fence
+		if strings.HasPrefix(line, "```") {
+			if fence == "" {
+				next = line
+			} else {
+				next = ""
+			}
+		}
+		if fits(join(append(chunk, line), next)) {
+			chunk = append(chunk, line)
+			fence = next
+			lines = lines[1:]
+			continue
+		}
+		if len(chunk) == carried {
+			// the line does not fit even in a chunk of its own, so cut it at the longest prefix that does
+			cut := longestFit(line, func(prefix string) bool {
+				return fits(join(append(chunk, prefix), fence))
+			})
+			chunk = append(chunk, line[:cut])
+			lines[0] = line[cut:]
+		}
+		chunks = append(chunks, join(chunk, fence))
+		chunk, carried = nil, 0
+		if fence != "" {
+			chunk, carried = []string{fence}, 1
+		}
+	}
+	if len(chunk) > carried {
+		chunks = append(chunks, strings.Join(chunk, "\n"))
+	}
+	return chunks
+}
+
+// longestFit returns the length in bytes of the longest prefix of s for which fits reports true,
+// cut at a character boundary. It returns at least the length of the first character.
+func longestFit(s string, fits func(prefix string) bool) int {
+	bounds := []int{}
+	for i := range s {
+		if i > 0 {
+			bounds = append(bounds, i)
+		}
+	}
+	bounds = append(bounds, len(s))
+	// bounds[n] is the end of the first n+1 characters; find the last one that fits
+	n := sort.Search(len(bounds), func(i int) bool { return !fits(s[:bounds[i]]) })
+	return bounds[max(n-1, 0)]
+}
+
+// uploadAttachments uploads the attachments of msgs and links them from their content.
+func (h *Handler) uploadAttachments(ctx context.Context, channel string, msgs []message) error {
+	u, ok := h.client.(fileUploader)
+	if !ok {
+		return nil
+	}
+	for i := range msgs {
+		if msgs[i].attachment == nil {
+			continue
+		}
+		fileURL, err := u.uploadFile(ctx, channel, "record.json", msgs[i].attachment)
+		if err != nil {
+			return err
+		}
+		msgs[i].content += "\n" + fileURL
+		msgs[i].attachment = nil
+	}
+	return nil
+}
+
+// post sends content to channel after passing it to Option.BeforeFlush.
+func (h *Handler) post(ctx context.Context, channel, content string) (string, error) {
+	if h.opt.BeforeFlush != nil {
+		h.opt.BeforeFlush(content)
+	}
+	id, err := h.client.Send(ctx, channel, content)
+	if err == nil {
+		h.stats.sent.Add(1)
+		h.scheduleDelete(ctx, id)
+	}
+	return id, err
+}
+
+// scheduleDelete deletes the message after Option.AutoDeleteAfter if the client supports it.
+func (h *Handler) scheduleDelete(ctx context.Context, messageID string) {
+	if h.opt.AutoDeleteAfter <= 0 {
+		return
+	}
+	d, ok := h.client.(deleter)
+	if !ok {
+		return
+	}
+	// keep the bot token carried by ctx, which is the one allowed to delete the message
+	ctx = context.WithoutCancel(ctx)
+	time.AfterFunc(h.opt.AutoDeleteAfter, func() {
+		h.reportError(d.deleteMessage(ctx, messageID))
+	})
+}
+
+// waitTurn blocks until Option.MinInterMessageDelay has elapsed since the previous post.
+func (h *Handler) waitTurn(ctx context.Context) error {
+	if h.opt.MinInterMessageDelay <= 0 {
+		return nil
+	}
+	if wait := time.Until(h.lastPost.Add(h.opt.MinInterMessageDelay)); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	h.lastPost = time.Now()
+	return nil
+}
+
+// channelLimiter is a token bucket per channel refilled at a fixed rate per minute.
+// A nil *channelLimiter allows everything.
+type channelLimiter struct {
+	perMinute int
+	tokens    map[string]float64
+	updated   map[string]time.Time
+}
+
+func newChannelLimiter(perMinute int) *channelLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &channelLimiter{
+		perMinute: perMinute,
+		tokens:    make(map[string]float64),
+		updated:   make(map[string]time.Time),
+	}
+}
+
+// allow reports whether a post to channel is allowed at now, consuming a token if so.
+func (l *channelLimiter) allow(channel string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	tokens, ok := l.tokens[channel]
+	if !ok {
+		tokens = float64(l.perMinute)
+	} else {
+		elapsed := now.Sub(l.updated[channel])
+		tokens = min(tokens+elapsed.Minutes()*float64(l.perMinute), float64(l.perMinute))
+	}
+	l.updated[channel] = now
+	if tokens < 1 {
+		l.tokens[channel] = tokens
+		return false
+	}
+	l.tokens[channel] = tokens - 1
+	return true
+}
+
+// sendContext returns the context used to send records at level.
+// It carries the bot token configured in Option.LevelBotTokens, if any.
+func (h *Handler) sendContext(ctx context.Context, level slog.Level) context.Context {
+	if token, ok := h.opt.LevelBotTokens[level]; ok {
+		ctx = context.WithValue(ctx, traq.ContextAccessToken, token)
+	}
+	return ctx
+}
+
+// groupByToken splits msgs into batches posted by the same bot, in order of first appearance.
+func (h *Handler) groupByToken(msgs []message) [][]message {
+	if len(msgs) == 0 {
+		return nil
+	}
+	if len(h.opt.LevelBotTokens) == 0 {
+		return [][]message{msgs}
+	}
+	var groups [][]message
+	index := make(map[string]int)
+	for _, msg := range msgs {
+		token := h.opt.LevelBotTokens[msg.level]
+		i, ok := index[token]
+		if !ok {
+			i = len(groups)
+			index[token] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], msg)
+	}
+	return groups
+}
+
+// maxMessageLength is the maximum number of characters traQ accepts in a message.
+const maxMessageLength = 10000
+
+// sendAsFile uploads content as a file and posts a summary linking to it.
+func (h *Handler) sendAsFile(ctx context.Context, u fileUploader, channel string, count int, content string) (string, error) {
+	fileURL, err := u.uploadFile(ctx, channel, "logs.md", []byte(content))
+	if err != nil {
+		return "", err
+	}
+	summary := fmt.Sprintf(":page_facing_up: %d log records (%d bytes) attached\n%s", count, len(content), fileURL)
+	return h.post(ctx, channel, summary)
+}
+
+// sendAlone posts msg in a message of its own, threading and pinning it as requested.
+func (h *Handler) sendAlone(ctx context.Context, channel string, msg message) error {
+	var id string
+	var err error
+	if msg.fingerprint != "" {
+		id, err = h.sendThreaded(ctx, channel, msg)
+	} else if err = h.waitTurn(ctx); err == nil {
+		id, err = h.post(ctx, channel, msg.content)
+	}
+	if err != nil || !msg.pin {
+		return err
+	}
+	if p, ok := h.client.(pinner); ok {
+		// msg is already posted, so a failed pin must not fail the send and re-post it
+		h.reportError(p.pin(ctx, id))
+	}
+	return nil
+}
+
+// sendThreaded posts msg as a reply to the first message with the same fingerprint,
+// or as a new root if there is none yet. It returns the ID of the posted message.
+func (h *Handler) sendThreaded(ctx context.Context, channel string, msg message) (string, error) {
+	if err := h.waitTurn(ctx); err != nil {
+		return "", err
+	}
+	if root, ok := h.threads[msg.fingerprint]; ok {
+		if r, ok := h.client.(replier); ok {
+			if h.opt.BeforeFlush != nil {
+				h.opt.BeforeFlush(msg.content)
+			}
+			id, err := r.reply(ctx, channel, root, msg.content)
+			if err == nil {
+				h.stats.sent.Add(1)
+				h.scheduleDelete(ctx, id)
+			}
+			return id, err
+		}
+	}
+	id, err := h.post(ctx, channel, msg.content)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := h.threads[msg.fingerprint]; !ok {
+		h.threads[msg.fingerprint] = id
+	}
+	return id, nil
+}
+
+func (h *Handler) reportError(err error) {
+	if err != nil && h.opt.OnInternalError != nil {
+		h.opt.OnInternalError(err)
+	}
+}
+
+// buildBatch joins the buffered messages into the content of a single traQ message.
+func (h *Handler) buildBatch(msgs []message) string {
+	var b strings.Builder
+	if h.opt.SeverityBadge {
+		if badge := severityBadge(msgs); badge != "" {
+			b.WriteString(badge)
+			b.WriteByte('\n')
+		}
+	}
+	if h.opt.ErrorsFirst || h.opt.PriorityKey != "" {
+		msgs = slices.Clone(msgs)
+		slices.SortStableFunc(msgs, func(a, b message) int {
+			if c := cmp.Compare(b.priority, a.priority); c != 0 || !h.opt.ErrorsFirst {
+				return c
+			}
+			return cmp.Compare(b.level, a.level)
+		})
+	}
+	toc := h.opt.TableOfContents && len(msgs) > 1
+	if toc {
+		b.WriteString(":bookmark_tabs: Contents")
+		for i, msg := range msgs {
+			title := msg.text
+			if title == "" {
+				title, _, _ = strings.Cut(msg.content, "\n")
+			}
+			fmt.Fprintf(&b, "\n%d. %s", i+1, title)
+		}
+		b.WriteByte('\n')
+	}
+	for i, msg := range msgs {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		if toc {
+			fmt.Fprintf(&b, "[%d] ", i+1)
+		}
+		b.WriteString(msg.content)
+	}
+	return b.String()
+}
+
+func severityBadge(msgs []message) string {
+	var warns, errs int
+	for _, msg := range msgs {
+		switch {
+		case msg.level >= slog.LevelError:
+			errs++
+		case msg.level >= slog.LevelWarn:
+			warns++
+		}
+	}
+
+	var badges []string
+	if warns > 0 {
+		badges = append(badges, fmt.Sprintf("⚠️%d", warns))
+	}
+	if errs > 0 {
+		badges = append(badges, fmt.Sprintf("🚨%d", errs))
+	}
+	return strings.Join(badges, " ")
+}
+
+func deepCopyMap(m map[string]any) map[string]any {
+	cp := make(map[string]any, len(m))
+	copyMapInto(cp, m)
+	return cp
+}
+
+func copyMapInto(dst, src map[string]any) {
+	for k, v := range src {
+		if vm, ok := v.(map[string]any); ok {
+			dst[k] = deepCopyMap(vm)
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+// exitFlushTimeout bounds how long the exit hook waits for pending records to be sent.
+const exitFlushTimeout = 5 * time.Second
+
+var exitFlush struct {
+	mu   sync.Mutex
+	h    *Handler
+	stop func()
+}
+
+// SetGlobalFlushOnExit registers h to be flushed, sending its pending records, when the
+// process receives SIGINT or SIGTERM. h stays open, so the records the application logs
+// while shutting down are still posted if it closes h. Passing nil unregisters the handler.
+//
+// After the flush, the hook stops listening and raises the signal again. If the application
+// does not handle the signal, the process then terminates by its default action. If it does,
+// through signal.Notify, it receives the signal a second time, which it may take as a request
+// to force quit; such applications should call Shutdown in their own shutdown path instead.
+//
+// Go offers no hook for other ways the process may end: os.Exit, an unrecovered panic in any
+// goroutine, and SIGKILL all terminate the process without flushing. The flush gives up after
+// a few seconds.
+func SetGlobalFlushOnExit(h *Handler) {
+	exitFlush.mu.Lock()
+	defer exitFlush.mu.Unlock()
+	if exitFlush.stop != nil {
+		exitFlush.stop()
+		exitFlush.stop = nil
+	}
+	exitFlush.h = h
+	if h == nil {
+		return
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	exitFlush.stop = func() {
+		signal.Stop(sigs)
+		close(stopped)
+	}
+	go func() {
+		select {
+		case sig := <-sigs:
+			flushOnExit()
+			signal.Stop(sigs)
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(sig)
+			}
+		case <-stopped:
+		}
+	}()
+}
+
+// flushOnExit flushes the handler registered by SetGlobalFlushOnExit and waits for it to finish sending.
+func flushOnExit() {
+	exitFlush.mu.Lock()
+	h := exitFlush.h
+	exitFlush.mu.Unlock()
+	if h == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exitFlushTimeout)
+	defer cancel()
+	h.reportError(h.Flush(ctx))
+}
+
+// NewClient creates a traQ API client that sends requests to baseURL (e.g. "https://q.trap.jp/api/v3")
+// through httpClient. A nil httpClient uses [http.DefaultClient].
+func NewClient(baseURL string, httpClient *http.Client) *traq.APIClient {
+	cfg := traq.NewConfiguration()
+	cfg.Servers = traq.ServerConfigurations{{URL: baseURL}}
+	cfg.HTTPClient = httpClient
+	return traq.NewAPIClient(cfg)
+}
+
+// Sender posts messages to traQ. It lets NewWithSender replace the built-in transport,
+// e.g. with a proxy or a test double.
+type Sender interface {
+	// Send posts content to the channel and returns the ID of the posted message.
+	Send(ctx context.Context, channelID, content string) (messageID string, err error)
+}
+
+// RateLimitError is returned by a Sender when traQ rejects a post with 429 Too Many Requests.
+// The handler then pauses sending for RetryAfter and sends the records again afterwards.
+type RateLimitError struct {
+	// RetryAfter is how long to wait before posting again.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("slogtraq: rate limited by traQ, retry after %s", e.RetryAfter)
+}
+
+// defaultRetryAfter is the pause after a 429 response without a valid Retry-After header.
+const defaultRetryAfter = 10 * time.Second
+
+// parseRetryAfter parses the value of a Retry-After header, given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return defaultRetryAfter
+}
+
+// replier is implemented by senders that can post a message as a reply to another one.
+type replier interface {
+	reply(ctx context.Context, channelID, parentID, content string) (messageID string, err error)
+}
+
+// stamper is implemented by senders that can add stamps to a message.
+type stamper interface {
+	addStamp(ctx context.Context, messageID, stampID string) error
+}
+
+// pinner is implemented by senders that can pin a message.
+type pinner interface {
+	pin(ctx context.Context, messageID string) error
+}
+
+// deleter is implemented by senders that can delete a message.
+type deleter interface {
+	deleteMessage(ctx context.Context, messageID string) error
+}
+
+// fileUploader is implemented by senders that can upload files to a channel.
+type fileUploader interface {
+	// uploadFile uploads data as a file and returns a URL that traQ embeds when posted.
+	uploadFile(ctx context.Context, channelID, name string, data []byte) (fileURL string, err error)
+}
+
+type traQClientWrapper struct {
+	client *traq.APIClient
+	token  string
+	// embed makes traQ convert mentions and channel links in posted content.
+	embed bool
+}
+
+func (c *traQClientWrapper) Send(ctx context.Context, channelID, content string) (string, error) {
+	ctx = c.withToken(ctx)
+	m, resp, err := c.client.MessageAPI.
+		PostMessage(ctx, channelID).
+		PostMessageRequest(traq.PostMessageRequest{Content: content, Embed: &c.embed}).
+		Execute()
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return "", &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	}
+	if err != nil {
+		return "", err
+	}
+	return m.Id, nil
+}
+
+// reply posts content with a link to the parent message, which traQ renders as a quote.
+func (c *traQClientWrapper) reply(ctx context.Context, channelID, parentID, content string) (string, error) {
+	return c.Send(ctx, channelID, content+"\n"+c.webURL()+"/messages/"+parentID)
+}
+
+func (c *traQClientWrapper) uploadFile(ctx context.Context, channelID, name string, data []byte) (string, error) {
+	// the generated client only accepts *os.File
+	f, err := os.CreateTemp("", "*-"+name)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	ctx = c.withToken(ctx)
+	info, _, err := c.client.FileAPI.
+		PostFile(ctx).
+		File(f).
+		ChannelId(channelID).
+		Execute()
+	if err != nil {
+		return "", err
+	}
+	return c.webURL() + "/files/" + info.Id, nil
+}
+
+// addStamp adds one of the stamp to the message.
+func (c *traQClientWrapper) addStamp(ctx context.Context, messageID, stampID string) error {
+	_, err := c.client.StampAPI.
+		AddMessageStamp(c.withToken(ctx), messageID, stampID).
+		PostMessageStampRequest(traq.PostMessageStampRequest{Count: 1}).
+		Execute()
+	return err
+}
+
+func (c *traQClientWrapper) pin(ctx context.Context, messageID string) error {
+	_, _, err := c.client.MessageAPI.CreatePin(c.withToken(ctx), messageID).Execute()
+	return err
+}
+
+func (c *traQClientWrapper) deleteMessage(ctx context.Context, messageID string) error {
+	_, err := c.client.MessageAPI.DeleteMessage(c.withToken(ctx), messageID).Execute()
+	return err
+}
+
+// withToken sets the bot token unless ctx already carries one.
+func (c *traQClientWrapper) withToken(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(traq.ContextAccessToken).(string); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, traq.ContextAccessToken, c.token)
+}
+
+// webURL returns the base URL of the traQ web client derived from the API server URL.
+func (c *traQClientWrapper) webURL() string {
+	servers := c.client.GetConfig().Servers
+	if len(servers) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(servers[0].URL, "/"), "/api/v3")
 }